@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const ImportStatusPending = "pending"
+const ImportStatusImported = "imported"
+
+// PortalAddressImportStatus tells which bitcoin backend nodes watch a registered address,
+// NextAttemptAt is in msec and only set while the import is pending
+type PortalAddressImportStatus struct {
+	IncognitoAddress string   `json:"incognitoAddress"`
+	BTCAddress       string   `json:"btcAddress"`
+	ImportStatus     string   `json:"importStatus"`
+	ImportedNodes    []string `json:"importedNodes"`
+	PendingNodes     []string `json:"pendingNodes"`
+	Attempts         int      `json:"attempts"`
+	NextAttemptAt    int64    `json:"nextAttemptAt,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+func startAddressImporter() {
+	log.Println("starting address importer...")
+	nodes := btcBackend.ImportNodes()
+	if len(nodes) > 0 && serviceCfg.LegacyImportNode != "" {
+		// addresses registered before imports were tracked were imported into the single node
+		// of the time, only the nodes added since need to rescan for them
+		migrated, err := DBMigrateLegacyPortalAddressImports(serviceCfg.LegacyImportNode)
+		if err != nil {
+			log.Printf("Could not mark legacy addresses as imported into node %v - Error %v\n", serviceCfg.LegacyImportNode, err)
+		} else if migrated > 0 {
+			log.Printf("marked %v legacy addresses as imported into node %v\n", migrated, serviceCfg.LegacyImportNode)
+		}
+	}
+	if len(nodes) > 0 {
+		requeued, err := DBRequeuePortalAddressImports(nodes, time.Now().Unix())
+		if err != nil {
+			log.Printf("Could not queue addresses missing from nodes %v - Error %v\n", nodes, err)
+		} else if requeued > 0 {
+			log.Printf("queued %v addresses missing from nodes %v for import\n", requeued, nodes)
+		}
+	}
+	for {
+		err := importPendingAddresses()
+		if err != nil {
+			log.Printf("Could not import pending addresses - Error %v\n", err)
+		}
+		time.Sleep(AddressImportInterval)
+	}
+}
+
+// importPendingAddresses imports the due addresses into the nodes they are missing from, one
+// call per node and group of addresses registered within AddressImportRescanWindow of each
+// other rescanning from the oldest registration of the group, so old addresses do not deepen
+// the rescan of new ones. Addresses failing on any node are retried later with an exponential backoff
+func importPendingAddresses() error {
+	addresses, err := DBGetPendingPortalAddressImports(time.Now().Unix(), AddressImportBatchSize)
+	if err != nil {
+		return err
+	}
+	for i := range addresses {
+		addresses[i].ImportError = ""
+	}
+	for _, node := range btcBackend.ImportNodes() {
+		missing := []*PortalAddressData{}
+		for i := range addresses {
+			if !containsString(addresses[i].ImportedNodes, node) {
+				missing = append(missing, &addresses[i])
+			}
+		}
+		for _, group := range groupByRegistrationTime(missing, AddressImportRescanWindow) {
+			btcAddresses := []string{}
+			for _, a := range group {
+				btcAddresses = append(btcAddresses, a.BTCAddress)
+			}
+			// groups are sorted newest first so the last address is the oldest one
+			errs := btcBackend.ImportAddresses(node, btcAddresses, group[len(group)-1].TimeStamp)
+			for j, a := range group {
+				if errs[j] != nil {
+					log.Printf("Could not import address %v to node %v - Error %v\n", a.BTCAddress, node, errs[j])
+					a.ImportError = errs[j].Error()
+					continue
+				}
+				a.ImportedNodes = append(a.ImportedNodes, node)
+			}
+		}
+	}
+
+	for i := range addresses {
+		a := &addresses[i]
+		if a.ImportError == "" {
+			a.ImportStatus = ImportStatusImported
+			a.NextImportAt = 0
+		} else {
+			a.ImportAttempts++
+			a.NextImportAt = time.Now().Add(getImportBackoff(a.ImportAttempts)).Unix()
+		}
+		err = DBUpdatePortalAddress(a)
+		if err != nil {
+			log.Printf("Could not update import status of address %v - Error %v\n", a.BTCAddress, err)
+		}
+	}
+	return nil
+}
+
+// groupByRegistrationTime sorts addresses newest first and splits them into groups registered
+// within window of the newest address of the group
+func groupByRegistrationTime(addresses []*PortalAddressData, window time.Duration) [][]*PortalAddressData {
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].TimeStamp > addresses[j].TimeStamp
+	})
+	groups := [][]*PortalAddressData{}
+	for _, a := range addresses {
+		last := len(groups) - 1
+		if last >= 0 && groups[last][0].TimeStamp-a.TimeStamp <= int64(window/time.Second) {
+			groups[last] = append(groups[last], a)
+			continue
+		}
+		groups = append(groups, []*PortalAddressData{a})
+	}
+	return groups
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getImportBackoff doubles the delay after each failed attempt up to AddressImportMaxBackoff
+func getImportBackoff(attempts int) time.Duration {
+	backoff := AddressImportBaseBackoff
+	for i := 1; i < attempts && backoff < AddressImportMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > AddressImportMaxBackoff {
+		backoff = AddressImportMaxBackoff
+	}
+	return backoff
+}
+
+func getPortalAddressImportStatus(address *PortalAddressData) *PortalAddressImportStatus {
+	status := &PortalAddressImportStatus{
+		IncognitoAddress: address.IncAddress,
+		BTCAddress:       address.BTCAddress,
+		ImportStatus:     address.ImportStatus,
+		ImportedNodes:    address.ImportedNodes,
+		PendingNodes:     []string{},
+		Attempts:         address.ImportAttempts,
+		Error:            address.ImportError,
+	}
+	if status.ImportedNodes == nil {
+		status.ImportedNodes = []string{}
+	}
+	// the stored status may predate nodes added since, or imports being queued at all
+	importedNodes := map[string]bool{}
+	for _, node := range address.ImportedNodes {
+		importedNodes[node] = true
+	}
+	for _, node := range btcBackend.ImportNodes() {
+		if !importedNodes[node] {
+			status.PendingNodes = append(status.PendingNodes, node)
+		}
+	}
+	if len(status.PendingNodes) > 0 {
+		status.ImportStatus = ImportStatusPending
+	} else {
+		status.ImportStatus = ImportStatusImported
+	}
+	if address.ImportStatus == ImportStatusPending {
+		status.NextAttemptAt = address.NextImportAt * 1000 // convert to msec
+	}
+	return status
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupByRegistrationTime(t *testing.T) {
+	const day = int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	addresses := []*PortalAddressData{}
+	for _, age := range []int64{0, 3 * 365 * day, day / 2, day - 1, 2 * day, 3*365*day + 1} {
+		addresses = append(addresses, &PortalAddressData{BTCAddress: string(rune('a' + len(addresses))), TimeStamp: now - age})
+	}
+
+	groups := groupByRegistrationTime(addresses, 24*time.Hour)
+	want := [][]string{{"a", "c", "d"}, {"e"}, {"b", "f"}}
+	if len(groups) != len(want) {
+		t.Fatalf("got %v groups, want %v", len(groups), len(want))
+	}
+	for i, group := range groups {
+		if len(group) != len(want[i]) {
+			t.Errorf("group %v has %v addresses, want %v", i, len(group), want[i])
+			continue
+		}
+		for j, a := range group {
+			if a.BTCAddress != want[i][j] {
+				t.Errorf("group %v holds %v at %v, want %v", i, a.BTCAddress, j, want[i][j])
+			}
+		}
+	}
+}
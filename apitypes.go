@@ -5,6 +5,57 @@ type API_add_portal_shielding_request struct {
 	BTCAddress string
 }
 
+type API_add_portal_shield_request struct {
+	IncAddress   string
+	ExternalTxID string
+	ReqTxID      string
+	TokenID      string
+}
+
+type API_add_portal_unshield_request struct {
+	IncAddress string
+	UnshieldID string
+	TokenID    string
+}
+
+type API_get_shield_status_by_external_txids_request struct {
+	TokenID       string
+	ExternalTxIDs []string
+}
+
+type API_generate_portal_shielding_address_respond struct {
+	IncAddress   string
+	BTCAddress   string
+	RedeemScript string
+	ChildPubKeys []string
+	KeySetEpoch  int
+	Registered   bool
+}
+
+type API_estimated_unshielding_fee_respond struct {
+	Inputs   int
+	Outputs  int
+	VBytes   float64
+	TokenID  string
+	Target   string
+	FeeRate  float64            // in satoshi per vbyte
+	FeeRates map[string]float64 // in satoshi per vbyte
+	FeeSat   uint64
+	FeePBTC  uint64 // in pBTC base units
+	// FeeUpdatedAt is the time of the last successful fee refresh in msec
+	FeeUpdatedAt int64
+	IsStale      bool
+}
+
+type API_shield_history_respond struct {
+	Histories  []PortalShieldHistory
+	Total      int
+	NextCursor string
+	// Partial is set when some histories are degraded, FailedTxIDs lists their external tx ids
+	Partial     bool
+	FailedTxIDs []string
+}
+
 type API_respond struct {
 	Result interface{}
 	Error  *string
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// bitcoindBackend talks to bitcoind fullnodes with wallet enabled, portal addresses must be
+// imported as watch-only into each of them for their UTXOs to be listed. Calls go to the
+// healthy node with the highest priority and fail over to the next one, wallet calls only go
+// to the nodes whose wallet watches the addresses or transactions involved
+type bitcoindBackend struct {
+	nodes []*bitcoindNode
+}
+
+type bitcoindNode struct {
+	config BTCFullnodeConfig
+
+	lock   sync.RWMutex
+	status BTCNodeStatus
+}
+
+// BTCNodeStatus is the result of the last health check of a node, nodes not synced or lagging
+// more than the configured number of blocks behind the best tip are unhealthy
+type BTCNodeStatus struct {
+	Name         string `json:"name"`
+	Priority     int    `json:"priority"`
+	Healthy      bool   `json:"healthy"`
+	Syncing      bool   `json:"syncing"`
+	TipHeight    int64  `json:"tipHeight"`
+	HeaderHeight int64  `json:"headerHeight"`
+	Lag          int64  `json:"lag"`
+	LastChecked  int64  `json:"lastChecked"` // in msec
+	Error        string `json:"error,omitempty"`
+}
+
+type estimateSmartFeeResult struct {
+	FeeRate *float64 `json:"feerate"` // in BTC/kvB
+	Errors  []string `json:"errors"`
+	Blocks  int64    `json:"blocks"`
+}
+
+type blockchainInfoResult struct {
+	Blocks               int64 `json:"blocks"`
+	Headers              int64 `json:"headers"`
+	InitialBlockDownload bool  `json:"initialblockdownload"`
+}
+
+type importMultiRequest struct {
+	ScriptPubKey map[string]string `json:"scriptPubKey"`
+	Timestamp    int64             `json:"timestamp"`
+	WatchOnly    bool              `json:"watchonly"`
+}
+
+type importMultiResult struct {
+	Success bool         `json:"success"`
+	Error   *btcRPCError `json:"error"`
+}
+
+func newBitcoindBackend() (*bitcoindBackend, error) {
+	backend := &bitcoindBackend{}
+	for _, nodeCfg := range serviceCfg.BTCFullnodes {
+		backend.nodes = append(backend.nodes, &bitcoindNode{
+			config: nodeCfg,
+			// nodes are assumed healthy until the first health check
+			status: BTCNodeStatus{Name: nodeCfg.Name, Priority: nodeCfg.Priority, Healthy: true},
+		})
+	}
+	sort.SliceStable(backend.nodes, func(i, j int) bool {
+		return backend.nodes[i].config.Priority < backend.nodes[j].config.Priority
+	})
+	return backend, nil
+}
+
+func startBTCNodeHealthChecker() {
+	backend, ok := btcBackend.(*bitcoindBackend)
+	if !ok {
+		return
+	}
+	log.Println("starting bitcoind node health checker...")
+	for {
+		backend.checkNodes()
+		time.Sleep(BTCNodeHealthCheckInterval)
+	}
+}
+
+// checkNodes refreshes the status of every node, the best tip is the highest one reported.
+// Probes time out early so a hung node does not hold up the checks of the others
+func (b *bitcoindBackend) checkNodes() {
+	infos := make([]*blockchainInfoResult, len(b.nodes))
+	errs := make([]error, len(b.nodes))
+	runBounded(len(b.nodes), len(b.nodes), func(i int) {
+		response, err := btcRequest(b.nodes[i].config, "getblockchaininfo", []interface{}{}, BTCNodeHealthCheckTimeout)
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		var info blockchainInfoResult
+		err = json.Unmarshal(response, &info)
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		infos[i] = &info
+	})
+
+	bestTipHeight := int64(0)
+	for _, info := range infos {
+		if info != nil && info.Blocks > bestTipHeight {
+			bestTipHeight = info.Blocks
+		}
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, node := range b.nodes {
+		status := BTCNodeStatus{Name: node.config.Name, Priority: node.config.Priority, LastChecked: now}
+		if errs[i] != nil {
+			status.Error = errs[i].Error()
+		} else {
+			status.TipHeight = infos[i].Blocks
+			status.HeaderHeight = infos[i].Headers
+			status.Syncing = infos[i].InitialBlockDownload
+			status.Lag = bestTipHeight - infos[i].Blocks
+			status.Healthy = !status.Syncing && status.Lag <= serviceCfg.MaxNodeLag
+		}
+		node.lock.Lock()
+		if node.status.Healthy && !status.Healthy {
+			log.Printf("bitcoind node %v is unhealthy - tip %v, best tip %v, syncing %v, error %v\n",
+				status.Name, status.TipHeight, bestTipHeight, status.Syncing, status.Error)
+		}
+		node.status = status
+		node.lock.Unlock()
+	}
+}
+
+// NodeStatuses returns the status of every node by priority
+func (b *bitcoindBackend) NodeStatuses() []BTCNodeStatus {
+	statuses := []BTCNodeStatus{}
+	for _, node := range b.nodes {
+		node.lock.RLock()
+		statuses = append(statuses, node.status)
+		node.lock.RUnlock()
+	}
+	return statuses
+}
+
+func (n *bitcoindNode) isHealthy() bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.status.Healthy
+}
+
+// getRoutedNodes returns the healthy nodes by priority followed by the unhealthy ones,
+// which are only tried when every healthy node fails
+func (b *bitcoindBackend) getRoutedNodes() []*bitcoindNode {
+	healthy := []*bitcoindNode{}
+	unhealthy := []*bitcoindNode{}
+	for _, node := range b.nodes {
+		if node.isHealthy() {
+			healthy = append(healthy, node)
+		} else {
+			unhealthy = append(unhealthy, node)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// call runs fn on the routed nodes until one answers, errors returned by bitcoind itself
+// are answers and do not fail over
+func (b *bitcoindBackend) call(fn func(node *bitcoindNode) error) error {
+	var err error
+	for _, node := range b.getRoutedNodes() {
+		err = fn(node)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*btcjson.RPCError); ok {
+			return err
+		}
+		log.Printf("Could not call bitcoind node %v - Error %v\n", node.config.Name, err)
+	}
+	return err
+}
+
+// rawRequest calls a bitcoind RPC method, giving up after BTCBackendTimeout
+func (n *bitcoindNode) rawRequest(method string, params ...interface{}) ([]byte, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	return btcRequest(n.config, method, params, BTCBackendTimeout)
+}
+
+// rawRequestInto calls a bitcoind RPC method and parses its result into result
+func (n *bitcoindNode) rawRequestInto(result interface{}, method string, params ...interface{}) error {
+	response, err := n.rawRequest(method, params...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(response, result)
+}
+
+func (n *bitcoindNode) getBlockCount() (int64, error) {
+	var tipHeight int64
+	err := n.rawRequestInto(&tipHeight, "getblockcount")
+	return tipHeight, err
+}
+
+func (b *bitcoindBackend) Name() string {
+	return BTCBackendBitcoind
+}
+
+// ImportNodes returns every node as each one has its own wallet
+func (b *bitcoindBackend) ImportNodes() []string {
+	names := []string{}
+	for _, node := range b.nodes {
+		names = append(names, node.config.Name)
+	}
+	return names
+}
+
+// ImportAddresses imports addresses as watch-only with a single importmulti call, which rescans
+// the blocks since they were registered so deposits made before a delayed import are found
+func (b *bitcoindBackend) ImportAddresses(nodeName string, addresses []string, since int64) []error {
+	errs := make([]error, len(addresses))
+	setErrs := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	var node *bitcoindNode
+	for _, n := range b.nodes {
+		if n.config.Name == nodeName {
+			node = n
+		}
+	}
+	if node == nil {
+		return setErrs(fmt.Errorf("Unknown bitcoind node %v", nodeName))
+	}
+	requests := []importMultiRequest{}
+	for _, address := range addresses {
+		requests = append(requests, importMultiRequest{
+			ScriptPubKey: map[string]string{"address": address},
+			Timestamp:    since,
+			WatchOnly:    true,
+		})
+	}
+	// the rescan runs within the call, which may take long for addresses registered long ago
+	response, err := btcRequest(node.config, "importmulti", []interface{}{requests, map[string]bool{"rescan": true}}, BTCImportTimeout)
+	if err != nil {
+		return setErrs(err)
+	}
+	var results []importMultiResult
+	err = json.Unmarshal(response, &results)
+	if err != nil || len(results) != len(addresses) {
+		return setErrs(fmt.Errorf("Could not parse response: %v", string(response)))
+	}
+	for i, result := range results {
+		if result.Success {
+			continue
+		}
+		errs[i] = fmt.Errorf("Could not import address %v", addresses[i])
+		if result.Error != nil {
+			errs[i] = fmt.Errorf("%v", result.Error.Message)
+		}
+	}
+	return errs
+}
+
+// getWatchingNodes returns the nodes each registered address has been imported into, addresses
+// that are not registered, like the change addresses of key sets, are imported by the operator
+// and are left out
+func getWatchingNodes(addresses []string) (map[string]map[string]bool, error) {
+	portalAddresses, err := DBGetPortalAddressesByBTCAddresses(addresses)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get imported nodes of addresses - Error %v", err)
+	}
+	watchingNodes := map[string]map[string]bool{}
+	for _, a := range portalAddresses {
+		nodes := map[string]bool{}
+		for _, node := range a.ImportedNodes {
+			nodes[node] = true
+		}
+		watchingNodes[a.BTCAddress] = nodes
+	}
+	return watchingNodes, nil
+}
+
+func isWatchedBy(watchingNodes map[string]map[string]bool, address string, nodeName string) bool {
+	nodes, ok := watchingNodes[address]
+	return !ok || nodes[nodeName]
+}
+
+// ListUTXOs lists the UTXOs of each address on a node whose wallet watches it, a node missing
+// the import would answer with no UTXOs. Addresses not imported into any node yet are skipped
+func (b *bitcoindBackend) ListUTXOs(addresses []string, minConf int64) ([]BTCUTXO, error) {
+	watchingNodes, err := getWatchingNodes(addresses)
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]bool{}
+	utxos := []BTCUTXO{}
+	var lastErr error
+	for _, node := range b.getRoutedNodes() {
+		nodeAddresses := []string{}
+		for _, a := range addresses {
+			if !listed[a] && isWatchedBy(watchingNodes, a, node.config.Name) {
+				nodeAddresses = append(nodeAddresses, a)
+			}
+		}
+		if len(nodeAddresses) == 0 {
+			continue
+		}
+		nodeUTXOs, err := node.listUTXOs(nodeAddresses, minConf)
+		if err != nil {
+			if _, ok := err.(*btcjson.RPCError); ok {
+				return nil, err
+			}
+			log.Printf("Could not call bitcoind node %v - Error %v\n", node.config.Name, err)
+			lastErr = err
+			continue
+		}
+		utxos = append(utxos, nodeUTXOs...)
+		for _, a := range nodeAddresses {
+			listed[a] = true
+		}
+	}
+
+	unimported := []string{}
+	for _, a := range addresses {
+		if listed[a] {
+			continue
+		}
+		if nodes, ok := watchingNodes[a]; !ok || len(nodes) > 0 {
+			return nil, fmt.Errorf("Could not list utxos of address %v on the nodes watching it - Error %v", a, lastErr)
+		}
+		unimported = append(unimported, a)
+	}
+	if len(unimported) > 0 {
+		log.Printf("Addresses %v are not imported into any bitcoind node yet, their utxos are not listed\n", unimported)
+	}
+	return utxos, nil
+}
+
+func (n *bitcoindNode) listUTXOs(addresses []string, minConf int64) ([]BTCUTXO, error) {
+	for _, a := range addresses {
+		_, err := btcutil.DecodeAddress(a, BTCChainCfg)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode address %v - with err: %v", a, err)
+		}
+	}
+	var unspents []btcjson.ListUnspentResult
+	err := n.rawRequestInto(&unspents, "listunspent", minConf, BTCMaxConf, addresses)
+	if err != nil {
+		return nil, err
+	}
+	utxos := []BTCUTXO{}
+	for _, u := range unspents {
+		amount, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, BTCUTXO{
+			TxID:          u.TxID,
+			Vout:          u.Vout,
+			Address:       u.Address,
+			Amount:        int64(amount),
+			Confirmations: u.Confirmations,
+		})
+	}
+	return utxos, nil
+}
+
+func (b *bitcoindBackend) GetTx(txID string) (*BTCTx, error) {
+	txIDHash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return nil, err
+	}
+	// nodes without txindex only find the transaction in their wallet, which may not be
+	// watching its addresses, so every node is tried until one finds it
+	for _, node := range b.getRoutedNodes() {
+		var tx *BTCTx
+		tx, err = node.getTx(txIDHash)
+		if err == nil {
+			return tx, nil
+		}
+		if _, ok := err.(*btcjson.RPCError); !ok {
+			log.Printf("Could not call bitcoind node %v - Error %v\n", node.config.Name, err)
+		}
+	}
+	return nil, err
+}
+
+// getTx uses getrawtransaction which only finds confirmed transactions on fullnodes with txindex,
+// wallet transactions are used as a fallback
+func (n *bitcoindNode) getTx(txIDHash *chainhash.Hash) (*BTCTx, error) {
+	tx := &BTCTx{TxID: txIDHash.String()}
+	var txHex string
+	var rawTx btcjson.TxRawResult
+	err := n.rawRequestInto(&rawTx, "getrawtransaction", txIDHash.String(), true)
+	if err == nil {
+		txHex = rawTx.Hex
+		tx.BlockHash, tx.BlockTime, tx.Confirmations = rawTx.BlockHash, rawTx.Blocktime, int64(rawTx.Confirmations)
+	} else {
+		// watch-only as portal addresses are imported without keys
+		var walletTx btcjson.GetTransactionResult
+		walletErr := n.rawRequestInto(&walletTx, "gettransaction", txIDHash.String(), true)
+		if walletErr != nil {
+			return nil, err
+		}
+		txHex = walletTx.Hex
+		tx.BlockHash, tx.BlockTime, tx.Confirmations = walletTx.BlockHash, walletTx.BlockTime, walletTx.Confirmations
+	}
+
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	var msgTx wire.MsgTx
+	err = msgTx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, err
+	}
+	tx.MsgTx = &msgTx
+	if tx.Confirmations > 0 {
+		tipHeight, err := n.getBlockCount()
+		if err != nil {
+			return nil, err
+		}
+		tx.BlockHeight = tipHeight - tx.Confirmations + 1
+	}
+	return tx, nil
+}
+
+// GetTxTimes sends batched gettransaction calls through a bounded pool, the wallet knows
+// when unconfirmed transactions were received. Transactions a node's wallet does not know
+// are looked up in the wallets of the next nodes
+func (b *bitcoindBackend) GetTxTimes(txIDs []string) (map[string]BTCTxTime, map[string]error) {
+	times := map[string]BTCTxTime{}
+	errs := map[string]error{}
+	batches := [][]string{}
+	for start := 0; start < len(txIDs); start += BTCRPCBatchSize {
+		end := start + BTCRPCBatchSize
+		if end > len(txIDs) {
+			end = len(txIDs)
+		}
+		batches = append(batches, txIDs[start:end])
+	}
+
+	var lock sync.Mutex
+	runBounded(len(batches), serviceCfg.MaxConcurrentRPC, func(i int) {
+		batchTimes := map[string]BTCTxTime{}
+		batchErrs := map[string]error{}
+		pending := batches[i]
+		for _, node := range b.getRoutedNodes() {
+			if len(pending) == 0 {
+				break
+			}
+			paramsList := [][]interface{}{}
+			for _, txID := range pending {
+				// watch-only as portal addresses are imported without keys
+				paramsList = append(paramsList, []interface{}{txID, true})
+			}
+			responses, err := btcBatchRequest(node.config, "gettransaction", paramsList)
+			if err != nil {
+				log.Printf("Could not call bitcoind node %v - Error %v\n", node.config.Name, err)
+				for _, txID := range pending {
+					batchErrs[txID] = err
+				}
+				continue
+			}
+
+			missed := []string{}
+			for j, txID := range pending {
+				if responses[j].Error != nil {
+					batchErrs[txID] = fmt.Errorf("%v", responses[j].Error.Message)
+					missed = append(missed, txID)
+					continue
+				}
+				var tx btcWalletTxTime
+				err := json.Unmarshal(responses[j].Result, &tx)
+				if err != nil {
+					batchErrs[txID] = err
+					missed = append(missed, txID)
+					continue
+				}
+				batchTimes[txID] = BTCTxTime{Time: tx.Time, Confirmed: tx.Confirmations > 0}
+				delete(batchErrs, txID)
+			}
+			pending = missed
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for txID, t := range batchTimes {
+			times[txID] = t
+		}
+		for txID, err := range batchErrs {
+			errs[txID] = err
+		}
+	})
+	return times, errs
+}
+
+func (b *bitcoindBackend) GetTipHeight() (int64, error) {
+	var tipHeight int64
+	err := b.call(func(node *bitcoindNode) error {
+		var err error
+		tipHeight, err = node.getBlockCount()
+		return err
+	})
+	return tipHeight, err
+}
+
+func (b *bitcoindBackend) Broadcast(txHex string) (string, error) {
+	var txID string
+	err := b.call(func(node *bitcoindNode) error {
+		response, err := node.rawRequest("sendrawtransaction", txHex)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(response, &txID)
+	})
+	return txID, err
+}
+
+func (b *bitcoindBackend) EstimateFee(confTarget int) (float64, error) {
+	var result estimateSmartFeeResult
+	err := b.call(func(node *bitcoindNode) error {
+		response, err := node.rawRequest("estimatesmartfee", confTarget)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(response, &result)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if result.FeeRate == nil {
+		return 0, fmt.Errorf("No fee estimate for target %v: %v", confTarget, result.Errors)
+	}
+	return *result.FeeRate * 1e8 / 1000, nil
+}
+
+func (b *bitcoindBackend) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	var blockHash *chainhash.Hash
+	err := b.call(func(node *bitcoindNode) error {
+		var blockHashStr string
+		err := node.rawRequestInto(&blockHashStr, "getblockhash", height)
+		if err != nil {
+			return err
+		}
+		blockHash, err = chainhash.NewHashFromStr(blockHashStr)
+		return err
+	})
+	return blockHash, err
+}
+
+func (b *bitcoindBackend) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	var block *wire.MsgBlock
+	err := b.call(func(node *bitcoindNode) error {
+		var blockHex string
+		err := node.rawRequestInto(&blockHex, "getblock", blockHash.String(), 0)
+		if err != nil {
+			return err
+		}
+		blockBytes, err := hex.DecodeString(blockHex)
+		if err != nil {
+			return err
+		}
+		block = &wire.MsgBlock{}
+		return block.Deserialize(bytes.NewReader(blockBytes))
+	})
+	return block, err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+func startBlockScanner() {
+	blockSource, ok := btcBackend.(BlockSource)
+	if !ok {
+		log.Printf("bitcoin backend %v does not serve blocks, block scanner is disabled\n", btcBackend.Name())
+		return
+	}
+	log.Println("starting block scanner...")
+	for {
+		err := scanNewBlocks(blockSource)
+		if err != nil {
+			log.Printf("Could not scan new blocks - Error %v\n", err)
+		}
+		time.Sleep(BlockScannerInterval)
+	}
+}
+
+// loadPortalScripts maps the hex encoded P2WSH script of every registered address to its record
+func loadPortalScripts() (map[string]PortalAddressData, error) {
+	addresses, err := DBGetAllPortalAddresses()
+	if err != nil {
+		return nil, err
+	}
+	scripts := map[string]PortalAddressData{}
+	for _, a := range addresses {
+		btcAddress, err := btcutil.DecodeAddress(a.BTCAddress, BTCChainCfg)
+		if err != nil {
+			log.Printf("Could not decode address %v - Error %v\n", a.BTCAddress, err)
+			continue
+		}
+		script, err := txscript.PayToAddrScript(btcAddress)
+		if err != nil {
+			log.Printf("Could not build script of address %v - Error %v\n", a.BTCAddress, err)
+			continue
+		}
+		scripts[hex.EncodeToString(script)] = a
+	}
+	return scripts, nil
+}
+
+// scanNewBlocks walks the main chain from the checkpoint to the tip and indexes
+// every output paying a registered address, rolling back deposits of reorged blocks
+func scanNewBlocks(blockSource BlockSource) error {
+	checkpoint, err := DBGetCheckpoint(BlockScannerCheckpoint)
+	if err != nil {
+		return err
+	}
+	tipHeight, err := btcBackend.GetTipHeight()
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		startHeight := serviceCfg.ScannerStartHeight
+		if startHeight <= 0 || startHeight > tipHeight {
+			// only follow new blocks
+			startHeight = tipHeight + 1
+		}
+		checkpoint, err = saveScannerCheckpoint(blockSource, startHeight-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	scripts, err := loadPortalScripts()
+	if err != nil {
+		return err
+	}
+
+	for checkpoint.BlockHeight < tipHeight {
+		height := checkpoint.BlockHeight + 1
+		blockHash, err := blockSource.GetBlockHash(height)
+		if err != nil {
+			return err
+		}
+		block, err := blockSource.GetBlock(blockHash)
+		if err != nil {
+			return err
+		}
+
+		if block.Header.PrevBlock.String() != checkpoint.BlockHash {
+			checkpoint, err = rollbackBlockScanner(blockSource, checkpoint.BlockHeight)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = indexBlockDeposits(block, blockHash.String(), height, scripts)
+		if err != nil {
+			return err
+		}
+		err = DBSaveScannedBlock(height, blockHash.String())
+		if err != nil {
+			return err
+		}
+		err = DBSaveCheckpoint(BlockScannerCheckpoint, blockHash.String(), height)
+		if err != nil {
+			return err
+		}
+		checkpoint.BlockHeight = height
+		checkpoint.BlockHash = blockHash.String()
+	}
+
+	err = verifyRecentDeposits(blockSource, tipHeight)
+	if err != nil {
+		return err
+	}
+	return DBDeleteScannedBlocksOutside(checkpoint.BlockHeight-MaxReorgDepth, checkpoint.BlockHeight)
+}
+
+// verifyRecentDeposits orphans deposits whose block is no longer in the main chain,
+// it catches reorgs the scanner has not walked through yet
+func verifyRecentDeposits(blockSource BlockSource, tipHeight int64) error {
+	blocks, err := DBGetRecentPortalDepositBlocks(tipHeight - MaxReorgDepth)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if b.BlockHeight > tipHeight {
+			// the node answering may lag behind the one the block was indexed from
+			continue
+		}
+		mainChainHash, err := blockSource.GetBlockHash(b.BlockHeight)
+		if err != nil {
+			return err
+		}
+		if mainChainHash.String() == b.BlockHash {
+			continue
+		}
+		orphaned, err := DBMarkPortalDepositsOrphanedByBlockHash(b.BlockHash)
+		if err != nil {
+			return err
+		}
+		log.Printf("block %v at %v left the main chain, orphaned %v deposits\n", b.BlockHash, b.BlockHeight, orphaned)
+	}
+	return nil
+}
+
+func indexBlockDeposits(block *wire.MsgBlock, blockHash string, height int64, scripts map[string]PortalAddressData) error {
+	for _, tx := range block.Transactions {
+		txID := tx.TxHash().String()
+		for vout, out := range tx.TxOut {
+			addressData, ok := scripts[hex.EncodeToString(out.PkScript)]
+			if !ok {
+				continue
+			}
+			item := NewPortalDepositData(addressData.IncAddress, addressData.BTCAddress, txID, uint32(vout), out.Value, blockHash, height, block.Header.Timestamp.Unix())
+			err := DBSavePortalDeposit(*item)
+			if err != nil {
+				return err
+			}
+			log.Printf("indexed deposit %v:%v to %v at block %v\n", txID, vout, addressData.BTCAddress, height)
+		}
+	}
+	return nil
+}
+
+// rollbackBlockScanner finds the highest scanned block still in the main chain,
+// marks the deposits indexed above it as orphaned and moves the checkpoint back to it
+func rollbackBlockScanner(blockSource BlockSource, fromHeight int64) (*PortalCheckpointData, error) {
+	forkHeight := fromHeight - 1
+	for ; forkHeight > fromHeight-MaxReorgDepth; forkHeight-- {
+		scannedBlock, err := DBGetScannedBlock(forkHeight)
+		if err != nil {
+			return nil, err
+		}
+		if scannedBlock == nil {
+			break
+		}
+		mainChainHash, err := blockSource.GetBlockHash(forkHeight)
+		if err != nil {
+			return nil, err
+		}
+		if mainChainHash.String() == scannedBlock.BlockHash {
+			break
+		}
+	}
+
+	orphaned, err := DBMarkPortalDepositsOrphanedFromHeight(forkHeight + 1)
+	if err != nil {
+		return nil, err
+	}
+	err = DBDeleteScannedBlocksOutside(forkHeight-MaxReorgDepth, forkHeight)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("reorg detected at block %v, orphaned %v deposits back to block %v\n", fromHeight, orphaned, forkHeight)
+	return saveScannerCheckpoint(blockSource, forkHeight)
+}
+
+func saveScannerCheckpoint(blockSource BlockSource, height int64) (*PortalCheckpointData, error) {
+	blockHash, err := blockSource.GetBlockHash(height)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get block hash at %v - Error %v", height, err)
+	}
+	err = DBSaveCheckpoint(BlockScannerCheckpoint, blockHash.String(), height)
+	if err != nil {
+		return nil, err
+	}
+	return &PortalCheckpointData{BlockHash: blockHash.String(), BlockHeight: height}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BTCUTXO is an unspent output of a watched address, Amount is in satoshi
+type BTCUTXO struct {
+	TxID          string
+	Vout          uint32
+	Address       string
+	Amount        int64
+	Confirmations int64
+}
+
+// BTCTx is a transaction with its position in the main chain, block fields are
+// zero while it is unconfirmed
+type BTCTx struct {
+	TxID          string
+	MsgTx         *wire.MsgTx
+	BlockHash     string
+	BlockHeight   int64
+	BlockTime     int64
+	Confirmations int64
+}
+
+// BTCTxTime is the time a transaction was seen or mined, in sec
+type BTCTxTime struct {
+	Time      int64
+	Confirmed bool
+}
+
+// BitcoinBackend is the view of the Bitcoin network the service relies on
+type BitcoinBackend interface {
+	Name() string
+	// ImportNodes returns the nodes every address has to be imported into, backends
+	// indexing every address have none
+	ImportNodes() []string
+	// ImportAddresses makes node watch addresses, registered at since (in sec) or later, the
+	// returned errors are in the order of addresses
+	ImportAddresses(node string, addresses []string, since int64) []error
+	ListUTXOs(addresses []string, minConf int64) ([]BTCUTXO, error)
+	GetTx(txID string) (*BTCTx, error)
+	// GetTxTimes returns the time of each transaction, those that could not be fetched are returned with their error
+	GetTxTimes(txIDs []string) (map[string]BTCTxTime, map[string]error)
+	GetTipHeight() (int64, error)
+	Broadcast(txHex string) (string, error)
+	// EstimateFee returns the fee rate in satoshi per vbyte to be mined within confTarget blocks
+	EstimateFee(confTarget int) (float64, error)
+}
+
+// BlockSource is implemented by backends serving full blocks, the block scanner needs one
+type BlockSource interface {
+	GetBlockHash(height int64) (*chainhash.Hash, error)
+	GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error)
+}
+
+var btcBackend BitcoinBackend
+
+func newBitcoinBackend() (BitcoinBackend, error) {
+	switch serviceCfg.BTCBackend {
+	case BTCBackendBitcoind:
+		return newBitcoindBackend()
+	case BTCBackendEsplora:
+		return newEsploraBackend(serviceCfg.Esplora), nil
+	case BTCBackendElectrum:
+		return newElectrumBackend(serviceCfg.Electrum.Address, serviceCfg.Electrum.TLS, serviceCfg.Electrum.SkipVerify), nil
+	}
+	return nil, fmt.Errorf("Unknown bitcoin backend %v", serviceCfg.BTCBackend)
+}
+
+// getConfirmationsFromHeight returns the confirmations of a transaction mined at blockHeight,
+// 0 if it is not mined
+func getConfirmationsFromHeight(blockHeight int64, tipHeight int64) int64 {
+	if blockHeight <= 0 || blockHeight > tipHeight {
+		return 0
+	}
+	return tipHeight - blockHeight + 1
+}
+
+// getTxTimes returns the time of each transaction from the cache or from the backend,
+// times of confirmed transactions are cached as they no longer change
+func getTxTimes(txIDs []string) (map[string]int64, map[string]error) {
+	times := map[string]int64{}
+	uncached := []string{}
+	seen := map[string]bool{}
+	for _, txID := range txIDs {
+		if seen[txID] {
+			continue
+		}
+		seen[txID] = true
+		if t, ok := txTimeCache.get(txID); ok {
+			times[txID] = t
+			continue
+		}
+		uncached = append(uncached, txID)
+	}
+	if len(uncached) == 0 {
+		return times, map[string]error{}
+	}
+
+	txTimes, errs := btcBackend.GetTxTimes(uncached)
+	for txID, t := range txTimes {
+		times[txID] = t.Time
+		if t.Confirmed {
+			txTimeCache.add(txID, t.Time)
+		}
+	}
+	return times, errs
+}
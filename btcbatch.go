@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+type btcRPCRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type btcRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type btcRPCResponse struct {
+	ID     int                `json:"id"`
+	Result stdjson.RawMessage `json:"result"`
+	Error  *btcRPCError       `json:"error"`
+}
+
+type btcWalletTxTime struct {
+	Time          int64 `json:"time"`
+	Confirmations int64 `json:"confirmations"`
+}
+
+// btcRPCClient sends the JSON-RPC calls to bitcoind nodes, rpcclient has no way to time out
+// a call so a hung node would block its callers forever. The timeout is set per request
+// as importmulti rescans take much longer than other calls
+var btcRPCClient = resty.New()
+
+// postBTCRPC posts a JSON-RPC request or batch to node and returns the response body, giving up
+// after timeout
+func postBTCRPC(node BTCFullnodeConfig, body []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	scheme := "http://"
+	if node.Https {
+		scheme = "https://"
+	}
+	response, err := btcRPCClient.R().
+		SetContext(ctx).
+		SetBasicAuth(node.User, node.Password).
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(scheme + node.Address)
+	if err != nil {
+		return nil, err
+	}
+	// bitcoind answers RPC errors of single requests with an error status and a JSON body
+	if response.StatusCode() != 200 && len(response.Body()) == 0 {
+		return nil, fmt.Errorf("Response status code: %v", response.StatusCode())
+	}
+	return response.Body(), nil
+}
+
+// btcRequest calls method on node, errors returned by bitcoind itself are *btcjson.RPCError
+func btcRequest(node BTCFullnodeConfig, method string, params []interface{}, timeout time.Duration) (stdjson.RawMessage, error) {
+	body, err := json.Marshal(btcRPCRequest{JSONRPC: "1.0", ID: 0, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := postBTCRPC(node, body, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var response btcRPCResponse
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse response: %v", string(responseBody))
+	}
+	if response.Error != nil {
+		return nil, &btcjson.RPCError{Code: btcjson.RPCErrorCode(response.Error.Code), Message: response.Error.Message}
+	}
+	return response.Result, nil
+}
+
+// btcBatchRequest sends one JSON-RPC batch calling method with each params to node, the responses
+// are returned in the order of paramsList
+func btcBatchRequest(node BTCFullnodeConfig, method string, paramsList [][]interface{}) ([]btcRPCResponse, error) {
+	requests := []btcRPCRequest{}
+	for i, params := range paramsList {
+		requests = append(requests, btcRPCRequest{JSONRPC: "1.0", ID: i, Method: method, Params: params})
+	}
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := postBTCRPC(node, body, BTCBackendTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []btcRPCResponse
+	err = json.Unmarshal(responseBody, &responses)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse response: %v", string(responseBody))
+	}
+	ordered := make([]btcRPCResponse, len(paramsList))
+	for _, r := range responses {
+		if r.ID < 0 || r.ID >= len(ordered) {
+			return nil, fmt.Errorf("Unexpected response id %v", r.ID)
+		}
+		ordered[r.ID] = r
+	}
+	return ordered, nil
+}
+
+// txLRU caches a value per transaction that no longer changes, e.g. the time of confirmed transactions
+type txLRU struct {
+	lock     sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type txLRUEntry struct {
+	txID  string
+	value int64
+}
+
+var txTimeCache *txLRU
+
+func newTxLRU(capacity int) *txLRU {
+	return &txLRU{capacity: capacity, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *txLRU) get(txID string) (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[txID]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*txLRUEntry).value, true
+}
+
+func (c *txLRU) add(txID string, value int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[txID]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value.(*txLRUEntry).value = value
+		return
+	}
+	c.items[txID] = c.order.PushFront(&txLRUEntry{txID: txID, value: value})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*txLRUEntry).txID)
+	}
+}
+
+// runBounded calls fn for 0..n-1 with at most limit calls running at the same time
+func runBounded(n int, limit int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
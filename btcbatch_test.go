@@ -0,0 +1,264 @@
+package main
+
+import (
+	stdjson "encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+const stubTxTime = 1600000000
+
+// btcRPCStub is a bitcoind JSON-RPC stub answering gettransaction, both as single and batched
+// requests, after delay to stand in for the network round trip
+type btcRPCStub struct {
+	// accessed atomically, kept first for 64-bit alignment
+	requests    int64
+	inflight    int64
+	maxInflight int64
+
+	delay       time.Duration
+	unknownTxID string
+}
+
+func (s *btcRPCStub) answer(request btcRPCRequest) btcRPCResponse {
+	response := btcRPCResponse{ID: request.ID}
+	txID := ""
+	if len(request.Params) > 0 {
+		txID, _ = request.Params[0].(string)
+	}
+	if request.Method != "gettransaction" || txID == s.unknownTxID {
+		response.Error = &btcRPCError{Code: -5, Message: "Invalid or non-wallet transaction id"}
+		return response
+	}
+	response.Result, _ = stdjson.Marshal(map[string]interface{}{
+		"txid":          txID,
+		"time":          stubTxTime,
+		"timereceived":  stubTxTime,
+		"confirmations": 3,
+		"details":       []interface{}{},
+		"hex":           "",
+	})
+	return response
+}
+
+func (s *btcRPCStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.requests, 1)
+	inflight := atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	for {
+		max := atomic.LoadInt64(&s.maxInflight)
+		if inflight <= max || atomic.CompareAndSwapInt64(&s.maxInflight, max, inflight) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		var requests []btcRPCRequest
+		err = stdjson.Unmarshal(body, &requests)
+		responses := []btcRPCResponse{}
+		for _, request := range requests {
+			responses = append(responses, s.answer(request))
+		}
+		result = responses
+	} else {
+		var request btcRPCRequest
+		err = stdjson.Unmarshal(body, &request)
+		result = s.answer(request)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	stdjson.NewEncoder(w).Encode(result)
+}
+
+func newStubRPCClient(t testing.TB, address string) *rpcclient.Client {
+	client, err := rpcclient.New(&rpcclient.ConnConfig{Host: address, HTTPPostMode: true, DisableTLS: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func newStubBitcoindBackend(url string) *bitcoindBackend {
+	address := strings.TrimPrefix(url, "http://")
+	return &bitcoindBackend{nodes: []*bitcoindNode{{
+		config: BTCFullnodeConfig{Name: "stub", Address: address},
+		status: BTCNodeStatus{Name: "stub", Healthy: true},
+	}}}
+}
+
+func newStubTxIDs(n int) []string {
+	txIDs := []string{}
+	for i := 0; i < n; i++ {
+		txIDs = append(txIDs, fmt.Sprintf("%064x", i+1))
+	}
+	return txIDs
+}
+
+// getTxTimesPerTx is the fan-out used before batching, one goroutine and one gettransaction
+// call per UTXO. Each goroutine has its own client as rpcclient clients race on their cookie
+// when used concurrently in HTTP POST mode
+func getTxTimesPerTx(clients []*rpcclient.Client, txIDs []string) map[string]int64 {
+	times := map[string]int64{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i, txID := range txIDs {
+		wg.Add(1)
+		go func(client *rpcclient.Client, txID string) {
+			defer wg.Done()
+			txIDHash, err := chainhash.NewHashFromStr(txID)
+			if err != nil {
+				return
+			}
+			tx, err := client.GetTransaction(txIDHash)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			times[txID] = tx.Time
+			lock.Unlock()
+		}(clients[i], txID)
+	}
+	wg.Wait()
+	return times
+}
+
+func TestGetTxTimesBatched(t *testing.T) {
+	serviceCfg.MaxConcurrentRPC = 2
+	stub := &btcRPCStub{delay: 10 * time.Millisecond, unknownTxID: fmt.Sprintf("%064x", 7)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	backend := newStubBitcoindBackend(server.URL)
+
+	txIDs := newStubTxIDs(4*BTCRPCBatchSize + 1)
+	times, errs := backend.GetTxTimes(txIDs)
+
+	if len(times) != len(txIDs)-1 {
+		t.Fatalf("got %v times, want %v", len(times), len(txIDs)-1)
+	}
+	for txID, txTime := range times {
+		if txTime.Time != stubTxTime || !txTime.Confirmed {
+			t.Errorf("time of %v is %+v", txID, txTime)
+		}
+	}
+	if len(errs) != 1 || errs[stub.unknownTxID] == nil {
+		t.Errorf("got errors %v, want only %v", errs, stub.unknownTxID)
+	}
+	if requests := atomic.LoadInt64(&stub.requests); requests != 5 {
+		t.Errorf("sent %v requests, want 5 batches", requests)
+	}
+	if maxInflight := atomic.LoadInt64(&stub.maxInflight); maxInflight > 2 {
+		t.Errorf("%v requests ran concurrently, limit is 2", maxInflight)
+	}
+}
+
+// benchmarkGetTxTimes times getTimes built by newGetTimes, which runs before the timer starts
+func benchmarkGetTxTimes(b *testing.B, numTxs int, newGetTimes func(backend *bitcoindBackend) func(txIDs []string)) {
+	serviceCfg.MaxConcurrentRPC = DefaultMaxConcurrentRPC
+	stub := &btcRPCStub{delay: time.Millisecond}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	backend := newStubBitcoindBackend(server.URL)
+	txIDs := newStubTxIDs(numTxs)
+	getTimes := newGetTimes(backend)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getTimes(txIDs)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&stub.requests))/float64(b.N), "requests/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&stub.maxInflight)), "max-inflight")
+}
+
+func BenchmarkGetTxTimesBatched(b *testing.B) {
+	benchmarkGetTxTimes(b, 500, func(backend *bitcoindBackend) func(txIDs []string) {
+		return func(txIDs []string) {
+			backend.GetTxTimes(txIDs)
+		}
+	})
+}
+
+func BenchmarkGetTxTimesPerTx(b *testing.B) {
+	const numTxs = 500
+	benchmarkGetTxTimes(b, numTxs, func(backend *bitcoindBackend) func(txIDs []string) {
+		clients := []*rpcclient.Client{}
+		for i := 0; i < numTxs; i++ {
+			clients = append(clients, newStubRPCClient(b, backend.nodes[0].config.Address))
+		}
+		return func(txIDs []string) {
+			getTxTimesPerTx(clients, txIDs)
+		}
+	})
+}
+
+func TestTxLRUEviction(t *testing.T) {
+	cache := newTxLRU(2)
+	cache.add("a", 1)
+	cache.add("b", 2)
+	// a becomes the most recently used so b is evicted next
+	if v, ok := cache.get("a"); !ok || v != 1 {
+		t.Fatalf("get a = %v, %v", v, ok)
+	}
+	cache.add("c", 3)
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("b was not evicted")
+	}
+	if v, ok := cache.get("c"); !ok || v != 3 {
+		t.Errorf("get c = %v, %v", v, ok)
+	}
+
+	cache.add("a", 4)
+	if v, ok := cache.get("a"); !ok || v != 4 {
+		t.Errorf("get updated a = %v, %v", v, ok)
+	}
+	if cache.order.Len() != 2 || len(cache.items) != 2 {
+		t.Errorf("cache holds %v entries, capacity is 2", cache.order.Len())
+	}
+}
+
+func TestRunBounded(t *testing.T) {
+	const n, limit = 50, 4
+	var inflight, maxInflight int64
+	calls := make([]int64, n)
+	runBounded(n, limit, func(i int) {
+		current := atomic.AddInt64(&inflight, 1)
+		for {
+			max := atomic.LoadInt64(&maxInflight)
+			if current <= max || atomic.CompareAndSwapInt64(&maxInflight, max, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt64(&calls[i], 1)
+		atomic.AddInt64(&inflight, -1)
+	})
+
+	for i, c := range calls {
+		if c != 1 {
+			t.Errorf("fn(%v) was called %v times", i, c)
+		}
+	}
+	if atomic.LoadInt64(&maxInflight) > limit {
+		t.Errorf("%v calls ran concurrently, limit is %v", maxInflight, limit)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
 )
 
 var ENABLE_PROFILER bool
@@ -13,11 +17,42 @@ var serviceCfg Config
 var BTCChainCfg *chaincfg.Params
 var BTCTokenID string
 
+// minShieldAmount is the minimum shielding amount of the configured network in pBTC base units
+var minShieldAmount uint64
+
+// requiredConfirmations is the number of BTC confirmations the portal requires before shielding
+var requiredConfirmations int
+
 type BTCFullnodeConfig struct {
+	Name     string `json:"name"`
 	Address  string `json:"address"`
 	User     string `json:"user"`
 	Password string `json:"pass"`
 	Https    bool   `json:"https"`
+	// Priority orders healthy nodes, the lowest one is used first
+	Priority int `json:"priority"`
+}
+
+type ElectrumConfig struct {
+	Address string `json:"address"`
+	TLS     bool   `json:"tls"`
+	// SkipVerify accepts any TLS certificate, for servers with self-signed ones
+	SkipVerify bool `json:"skipverify"`
+}
+
+type PortalKeySetConfig struct {
+	Epoch            int      `json:"epoch"`
+	ActivationHeight uint64   `json:"activationheight"`
+	ActivationTime   int64    `json:"activationtime"`
+	MasterPubKeys    []string `json:"masterpubkeys"`
+	NumSigsRequired  int      `json:"numsigsrequired"`
+}
+
+type FeeConfig struct {
+	// StaticFeeRates maps a fee target (fast, medium, slow) to the rate used when no fee source answers
+	StaticFeeRates map[string]float64 `json:"staticfeerates"`
+	MinFeeRate     float64            `json:"minfeerate"`
+	MaxFeeRate     float64            `json:"maxfeerate"`
 }
 
 type Config struct {
@@ -26,7 +61,35 @@ type Config struct {
 	MongoDB           string            `json:"mongodb"`
 	BTCFullnode       BTCFullnodeConfig `json:"btcfullnode"`
 	BlockchainFeeHost string            `json:"blockchainfee"`
+	Fee               FeeConfig         `json:"fee"`
+	IncognitoFullnode string            `json:"incognitofullnode"`
 	Net               string            `json:"net"`
+	// TokenID overrides the portal BTC token ID of the network, required for regtest and signet
+	TokenID string `json:"tokenid"`
+	// PortalKeySets maps a network name to its portal key set epochs (hex encoded compressed master pubkeys
+	// and the m-of-n threshold), mainnet falls back to the built-in keys as epoch 0
+	PortalKeySets map[string][]PortalKeySetConfig `json:"portalkeysets"`
+	// MinShieldAmounts maps a network name to its minimum shielding amount in pBTC base units
+	MinShieldAmounts map[string]uint64 `json:"minshieldamounts"`
+	// RequiredConfirmations maps a network name to the confirmations required before shielding
+	RequiredConfirmations map[string]int `json:"requiredconfirmations"`
+	// MaxConcurrentRPC bounds the concurrent calls to the BTC fullnode of a single request
+	MaxConcurrentRPC int `json:"maxconcurrentrpc"`
+	TxTimeCacheSize  int `json:"txtimecachesize"`
+	// ScannerStartHeight is the first block indexed by the block scanner when it has no checkpoint,
+	// it follows new blocks only if unset
+	ScannerStartHeight int64 `json:"scannerstartheight"`
+	// BTCBackend is where bitcoin data comes from: bitcoind (default), esplora or electrum
+	BTCBackend string         `json:"btcbackend"`
+	Esplora    string         `json:"esplora"`
+	Electrum   ElectrumConfig `json:"electrum"`
+	// BTCFullnodes are the bitcoind nodes to fail over between, btcfullnode is used alone if it is empty
+	BTCFullnodes []BTCFullnodeConfig `json:"btcfullnodes"`
+	// LegacyImportNode is the node addresses registered before imports were tracked were imported
+	// into, the one btcfullnode points to if it is empty
+	LegacyImportNode string `json:"legacyimportnode"`
+	// MaxNodeLag is the number of blocks a node can be behind the best tip and still be used
+	MaxNodeLag int64 `json:"maxnodelag"`
 }
 
 func readConfigAndArg() {
@@ -54,15 +117,175 @@ func readConfigAndArg() {
 	if tempCfg.MongoDB == "" {
 		tempCfg.MongoDB = DefaultMongoDB
 	}
-	if tempCfg.Net == "test" {
+	if tempCfg.MaxConcurrentRPC <= 0 {
+		tempCfg.MaxConcurrentRPC = DefaultMaxConcurrentRPC
+	}
+	if tempCfg.TxTimeCacheSize <= 0 {
+		tempCfg.TxTimeCacheSize = DefaultTxTimeCacheSize
+	}
+	switch tempCfg.BTCBackend {
+	case "":
+		tempCfg.BTCBackend = BTCBackendBitcoind
+	case BTCBackendBitcoind:
+	case BTCBackendEsplora:
+		if tempCfg.Esplora == "" {
+			panic("Esplora URL is not configured")
+		}
+	case BTCBackendElectrum:
+		if tempCfg.Electrum.Address == "" {
+			panic("Electrum server address is not configured")
+		}
+	default:
+		panic("Invalid config bitcoin backend")
+	}
+	if len(tempCfg.BTCFullnodes) == 0 && tempCfg.BTCFullnode.Address != "" {
+		tempCfg.BTCFullnodes = []BTCFullnodeConfig{tempCfg.BTCFullnode}
+	}
+	if tempCfg.BTCBackend == BTCBackendBitcoind && len(tempCfg.BTCFullnodes) == 0 {
+		panic("No bitcoind fullnode is configured")
+	}
+	nodeNames := map[string]bool{}
+	for i := range tempCfg.BTCFullnodes {
+		if tempCfg.BTCFullnodes[i].Name == "" {
+			tempCfg.BTCFullnodes[i].Name = fmt.Sprintf("node%v", i)
+		}
+		if nodeNames[tempCfg.BTCFullnodes[i].Name] {
+			panic(fmt.Sprintf("Duplicated bitcoind node name %v", tempCfg.BTCFullnodes[i].Name))
+		}
+		nodeNames[tempCfg.BTCFullnodes[i].Name] = true
+		if tempCfg.LegacyImportNode == "" && tempCfg.BTCFullnode.Address != "" && tempCfg.BTCFullnodes[i].Address == tempCfg.BTCFullnode.Address {
+			tempCfg.LegacyImportNode = tempCfg.BTCFullnodes[i].Name
+		}
+	}
+	if tempCfg.LegacyImportNode != "" && !nodeNames[tempCfg.LegacyImportNode] {
+		panic(fmt.Sprintf("Legacy import node %v is not a configured bitcoind node", tempCfg.LegacyImportNode))
+	}
+	if tempCfg.MaxNodeLag <= 0 {
+		tempCfg.MaxNodeLag = DefaultMaxNodeLag
+	}
+	if tempCfg.Fee.MinFeeRate == 0 {
+		tempCfg.Fee.MinFeeRate = DefaultMinFeeRate
+	}
+	if tempCfg.Fee.MaxFeeRate == 0 {
+		tempCfg.Fee.MaxFeeRate = DefaultMaxFeeRate
+	}
+	if tempCfg.Fee.MinFeeRate > tempCfg.Fee.MaxFeeRate {
+		panic("Invalid config fee rate bounds")
+	}
+	switch tempCfg.Net {
+	case "test":
 		BTCChainCfg = &chaincfg.TestNet3Params
 		BTCTokenID = TESTNET_BTC_ID
-	} else if tempCfg.Net == "main" {
+	case "main":
 		BTCChainCfg = &chaincfg.MainNetParams
 		BTCTokenID = MAINNET_BTC_ID
-	} else {
+	case "regtest":
+		BTCChainCfg = &chaincfg.RegressionNetParams
+	case "signet":
+		BTCChainCfg = newSignetParams()
+	default:
 		panic("Invalid config network Bitcoin")
 	}
+	if tempCfg.TokenID != "" {
+		BTCTokenID = tempCfg.TokenID
+	}
+	if BTCTokenID == "" {
+		panic(fmt.Sprintf("Token ID of network %v is not configured", tempCfg.Net))
+	}
+	portalKeySets, err = loadPortalKeySets(tempCfg.Net, tempCfg.PortalKeySets)
+	if err != nil {
+		panic(err)
+	}
+	for _, keySet := range portalKeySets {
+		if keySet.ActivationHeight > 0 && tempCfg.IncognitoFullnode == "" {
+			panic(fmt.Sprintf("Portal key set epoch %v activates at a beacon height, incognitofullnode must be configured", keySet.Epoch))
+		}
+	}
+	minShieldAmount = tempCfg.MinShieldAmounts[tempCfg.Net]
+	requiredConfirmations = DefaultRequiredConfirmations
+	if confirmations, ok := tempCfg.RequiredConfirmations[tempCfg.Net]; ok {
+		if confirmations < 1 {
+			panic("Invalid config required confirmations")
+		}
+		requiredConfirmations = confirmations
+	}
 	ENABLE_PROFILER = *argProfiler
 	serviceCfg = tempCfg
 }
+
+// newSignetParams returns the default signet params, signet shares address encodings with testnet3
+// so only the fields identifying the network differ
+func newSignetParams() *chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "signet"
+	params.Net = wire.BitcoinNet(0x40cf030a)
+	params.DefaultPort = "38333"
+	params.DNSSeeds = nil
+	params.Checkpoints = nil
+	return &params
+}
+
+func loadPortalKeySets(net string, keySetConfigs map[string][]PortalKeySetConfig) ([]*PortalKeySet, error) {
+	configs, ok := keySetConfigs[net]
+	if !ok || len(configs) == 0 {
+		var keySet *PortalKeySet
+		switch net {
+		case "main":
+			keySet = &PortalKeySet{MasterPubKeys: mainnetMasterPubKeys, NumSigsRequired: mainnetNumSigsRequired}
+		case "test":
+			keySet = &PortalKeySet{MasterPubKeys: testnetMasterPubKeys, NumSigsRequired: testnetNumSigsRequired}
+		}
+		if keySet != nil {
+			return []*PortalKeySet{keySet}, validatePortalKeySet(net, keySet.MasterPubKeys, keySet.NumSigsRequired)
+		}
+		return nil, fmt.Errorf("Portal key set of network %v is not configured", net)
+	}
+
+	keySets := []*PortalKeySet{}
+	for i, keySetCfg := range configs {
+		if i > 0 && keySetCfg.Epoch <= configs[i-1].Epoch {
+			return nil, fmt.Errorf("Portal key set epochs of network %v must be in ascending order", net)
+		}
+		pubKeys := [][]byte{}
+		for idx, pubKeyStr := range keySetCfg.MasterPubKeys {
+			pubKey, err := hex.DecodeString(pubKeyStr)
+			if err != nil {
+				return nil, fmt.Errorf("Master BTC Public Key (#%v) of network %v is not hex encoded - Error %v", idx, net, err)
+			}
+			pubKeys = append(pubKeys, pubKey)
+		}
+		err := validatePortalKeySet(net, pubKeys, keySetCfg.NumSigsRequired)
+		if err != nil {
+			return nil, fmt.Errorf("Portal key set epoch %v: %v", keySetCfg.Epoch, err)
+		}
+		keySets = append(keySets, &PortalKeySet{
+			Epoch:            keySetCfg.Epoch,
+			ActivationHeight: keySetCfg.ActivationHeight,
+			ActivationTime:   keySetCfg.ActivationTime,
+			MasterPubKeys:    pubKeys,
+			NumSigsRequired:  keySetCfg.NumSigsRequired,
+		})
+	}
+	return keySets, nil
+}
+
+// validatePortalKeySet checks that every master public key is a compressed secp256k1 point
+// and that the m-of-n threshold can be expressed by OP_CHECKMULTISIG
+func validatePortalKeySet(net string, pubKeys [][]byte, numSigsRequired int) error {
+	if len(pubKeys) == 0 || len(pubKeys) > MaxMultisigPubKeys {
+		return fmt.Errorf("Portal key set of network %v has %v keys, expected 1 to %v", net, len(pubKeys), MaxMultisigPubKeys)
+	}
+	if numSigsRequired < 1 || numSigsRequired > len(pubKeys) {
+		return fmt.Errorf("Portal key set of network %v requires %v of %v signatures", net, numSigsRequired, len(pubKeys))
+	}
+	for idx, pubKey := range pubKeys {
+		if len(pubKey) != btcec.PubKeyBytesLenCompressed {
+			return fmt.Errorf("Master BTC Public Key (#%v) of network %v is not compressed", idx, net)
+		}
+		_, err := btcec.ParsePubKey(pubKey, btcec.S256())
+		if err != nil {
+			return fmt.Errorf("Master BTC Public Key (#%v) of network %v is invalid - Error %v", idx, net, err)
+		}
+	}
+	return nil
+}
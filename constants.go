@@ -4,6 +4,30 @@ import "time"
 
 const (
 	DB_OPERATION_TIMEOUT time.Duration = 1 * time.Second
+
+	BlockScannerInterval             time.Duration = 30 * time.Second
+	DepositWatcherInterval           time.Duration = 1 * time.Minute
+	UnshieldTrackerInterval          time.Duration = 1 * time.Minute
+	BeaconHeightInterval             time.Duration = 30 * time.Second
+	FeeRefreshInterval               time.Duration = 1 * time.Minute
+	FeeStaleAfter                    time.Duration = 10 * time.Minute
+	PortalUTXORefreshInterval        time.Duration = 1 * time.Minute
+	PortalUTXORefreshIntervalIndexer time.Duration = 15 * time.Minute
+	FeeHostTimeout                   time.Duration = 10 * time.Second
+	BTCBackendTimeout                time.Duration = 30 * time.Second
+	BTCNodeHealthCheckInterval       time.Duration = 30 * time.Second
+	BTCNodeHealthCheckTimeout        time.Duration = 10 * time.Second
+	BTCImportTimeout                 time.Duration = 1 * time.Hour
+	AddressImportInterval            time.Duration = 10 * time.Second
+	AddressImportBaseBackoff         time.Duration = 30 * time.Second
+	AddressImportMaxBackoff          time.Duration = 1 * time.Hour
+	AddressImportRescanWindow        time.Duration = 24 * time.Hour
+)
+
+const (
+	BTCBackendBitcoind = "bitcoind"
+	BTCBackendEsplora  = "esplora"
+	BTCBackendElectrum = "electrum"
 )
 
 const (
@@ -14,9 +38,61 @@ const (
 
 	BTCMinConf = 0
 	BTCMaxConf = 9999999
+
+	DefaultRequiredConfirmations = 6
+
+	DefaultMaxConcurrentRPC = 8
+	DefaultTxTimeCacheSize  = 10000
+	BTCRPCBatchSize         = 50
+	DefaultMaxNodeLag       = 3
+	AddressImportBatchSize  = 100
+
+	DefaultHistoryPageSize     = 50
+	MaxHistoryPageSize         = 500
+	MaxIncAddressesPerRequest  = 20
+	MaxExternalTxIDsPerRequest = 50
+
+	BlockScannerCheckpoint   = "blockscanner"
+	DepositWatcherCheckpoint = "depositwatcher"
+	MaxReorgDepth            = 100
+
+	// OP_CHECKMULTISIG in a P2WSH redeem script is standard up to 15 public keys
+	MaxMultisigPubKeys = 15
 )
 
 const (
 	TESTNET_BTC_ID = "4584d5e9b2fc0337dfb17f4b5bb025e5b82c38cfa4f54e8a3d4fcdd03954ff82"
 	MAINNET_BTC_ID = "b832e5d3b1f01a4f0623f7fe91d6673461e1f5d37d91fe78c5c2e6183ff39696"
 )
+
+const (
+	IncRPCGetShieldingStatus   = "getportalshieldingrequeststatus"
+	IncRPCGetUnshieldingStatus = "getportalunshieldrequeststatus"
+	IncRPCGetBeaconBestState   = "getbeaconbeststate"
+
+	IncPortalRequestAcceptedStatus = 1
+	IncPortalRequestRejectedStatus = 2
+
+	IncPortalUnshieldWaitingStatus   = 0
+	IncPortalUnshieldProcessedStatus = 1
+	IncPortalUnshieldCompletedStatus = 2
+	IncPortalUnshieldRefundedStatus  = 3
+)
+
+const (
+	FeeTargetFast   = "fast"
+	FeeTargetMedium = "medium"
+	FeeTargetSlow   = "slow"
+
+	// in satoshi per vbyte
+	DefaultMinFeeRate = 1.0
+	DefaultMaxFeeRate = 500.0
+	DustRelayFeeRate  = 3.0
+)
+
+// FeeTargets maps a fee target to the number of blocks the transaction should be mined within
+var FeeTargets = map[string]int{
+	FeeTargetFast:   2,
+	FeeTargetMedium: 6,
+	FeeTargetSlow:   144,
+}
@@ -11,12 +11,24 @@ type PortalAddressData struct {
 	IncAddress       string `json:"incaddress" bson:"incaddress"`
 	BTCAddress       string `json:"btcaddress" bson:"btcaddress"`
 	TimeStamp        int64  `json:"timestamp" bson:"timestamp"`
+	// KeySetEpoch is the portal key set epoch the address was derived from,
+	// records saved before epochs were introduced decode as epoch 0
+	KeySetEpoch int `json:"keysetepoch" bson:"keysetepoch"`
+	// ImportStatus tracks the import of the address into the bitcoin backend nodes, records
+	// saved before imports were queued decode as "" and are migrated at startup as imported
+	// into the legacy import node
+	ImportStatus   string   `json:"importstatus" bson:"importstatus"`
+	ImportedNodes  []string `json:"importednodes" bson:"importednodes"`
+	ImportAttempts int      `json:"importattempts" bson:"importattempts"`
+	NextImportAt   int64    `json:"nextimportat" bson:"nextimportat"`
+	ImportError    string   `json:"importerror" bson:"importerror"`
 }
 
-func NewPortalAddressData(incAddress, btcAddress string) *PortalAddressData {
+func NewPortalAddressData(incAddress, btcAddress string, keySetEpoch int) *PortalAddressData {
 	timestamp := time.Now().Unix()
 	return &PortalAddressData{
-		IncAddress: incAddress, BTCAddress: btcAddress, TimeStamp: timestamp,
+		IncAddress: incAddress, BTCAddress: btcAddress, TimeStamp: timestamp, KeySetEpoch: keySetEpoch,
+		ImportStatus: ImportStatusPending, ImportedNodes: []string{}, NextImportAt: timestamp,
 	}
 }
 
@@ -35,3 +47,96 @@ func (model *PortalAddressData) Saving() error {
 
 	return nil
 }
+
+// PortalDepositData is a confirmed incoming output paying a registered portal address,
+// it is kept after the output is spent so histories stay complete
+type PortalDepositData struct {
+	mgm.DefaultModel `bson:",inline"`
+	IncAddress       string `json:"incaddress" bson:"incaddress"`
+	BTCAddress       string `json:"btcaddress" bson:"btcaddress"`
+	ExternalTxID     string `json:"externaltxid" bson:"externaltxid"`
+	Vout             uint32 `json:"vout" bson:"vout"`
+	Amount           int64  `json:"amount" bson:"amount"` // in satoshi
+	BlockHash        string `json:"blockhash" bson:"blockhash"`
+	BlockHeight      int64  `json:"blockheight" bson:"blockheight"`
+	BlockTime        int64  `json:"blocktime" bson:"blocktime"`
+	// Orphaned is set when the block containing the deposit is no longer in the main chain
+	Orphaned bool `json:"orphaned" bson:"orphaned"`
+}
+
+func NewPortalDepositData(incAddress, btcAddress, externalTxID string, vout uint32, amount int64, blockHash string, blockHeight int64, blockTime int64) *PortalDepositData {
+	return &PortalDepositData{
+		IncAddress: incAddress, BTCAddress: btcAddress, ExternalTxID: externalTxID, Vout: vout, Amount: amount,
+		BlockHash: blockHash, BlockHeight: blockHeight, BlockTime: blockTime,
+	}
+}
+
+func (model *PortalDepositData) Creating() error {
+	curTime := time.Now().UTC()
+	model.DefaultModel.DateFields.CreatedAt = curTime
+	model.DefaultModel.DateFields.UpdatedAt = curTime
+	return nil
+}
+
+// PortalCheckpointData stores the last block processed by a background worker
+type PortalCheckpointData struct {
+	mgm.DefaultModel `bson:",inline"`
+	Name             string `json:"name" bson:"name"`
+	BlockHash        string `json:"blockhash" bson:"blockhash"`
+	BlockHeight      int64  `json:"blockheight" bson:"blockheight"`
+}
+
+// PortalScannedBlockData is a block processed by the block scanner, used to find the fork point on reorgs
+type PortalScannedBlockData struct {
+	mgm.DefaultModel `bson:",inline"`
+	BlockHeight      int64  `json:"blockheight" bson:"blockheight"`
+	BlockHash        string `json:"blockhash" bson:"blockhash"`
+}
+
+// PortalUnshieldData is an unshield request of an Incognito address, kept in sync with the Incognito chain
+// PortalShieldRequestData links the Incognito shielding request submitted for a deposit to its
+// external transaction, the chain only serves shielding statuses by request tx id
+type PortalShieldRequestData struct {
+	mgm.DefaultModel `bson:",inline"`
+	IncAddress       string `json:"incaddress" bson:"incaddress"`
+	ExternalTxID     string `json:"externaltxid" bson:"externaltxid"`
+	ReqTxID          string `json:"reqtxid" bson:"reqtxid"`
+	TokenID          string `json:"tokenid" bson:"tokenid"`
+	TimeStamp        int64  `json:"timestamp" bson:"timestamp"`
+}
+
+func NewPortalShieldRequestData(incAddress, externalTxID, reqTxID, tokenID string) *PortalShieldRequestData {
+	timestamp := time.Now().Unix()
+	return &PortalShieldRequestData{
+		IncAddress: incAddress, ExternalTxID: externalTxID, ReqTxID: reqTxID, TokenID: tokenID, TimeStamp: timestamp,
+	}
+}
+
+type PortalUnshieldData struct {
+	mgm.DefaultModel `bson:",inline"`
+	IncAddress       string `json:"incaddress" bson:"incaddress"`
+	UnshieldID       string `json:"unshieldid" bson:"unshieldid"`
+	TokenID          string `json:"tokenid" bson:"tokenid"`
+	RemoteAddress    string `json:"remoteaddress" bson:"remoteaddress"`
+	Amount           uint64 `json:"amount" bson:"amount"`
+	ExternalTxID     string `json:"externaltxid" bson:"externaltxid"`
+	ExternalFee      uint64 `json:"externalfee" bson:"externalfee"`
+	// ExternalBlockHeight is the height of the block the BTC transaction was mined in, 0 until then
+	ExternalBlockHeight int64 `json:"externalblockheight" bson:"externalblockheight"`
+	Status              int   `json:"status" bson:"status"`
+	TimeStamp           int64 `json:"timestamp" bson:"timestamp"`
+}
+
+func NewPortalUnshieldData(incAddress, unshieldID, tokenID string) *PortalUnshieldData {
+	timestamp := time.Now().Unix()
+	return &PortalUnshieldData{
+		IncAddress: incAddress, UnshieldID: unshieldID, TokenID: tokenID, Status: UnshieldStatusPending, TimeStamp: timestamp,
+	}
+}
+
+func (model *PortalUnshieldData) Creating() error {
+	curTime := time.Now().UTC()
+	model.DefaultModel.DateFields.CreatedAt = curTime
+	model.DefaultModel.DateFields.UpdatedAt = curTime
+	return nil
+}
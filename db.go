@@ -39,6 +39,9 @@ func DBCreatePortalAddressIndex() error {
 		{
 			Keys: bsonx.Doc{{Key: "timestamp", Value: bsonx.Int32(1)}},
 		},
+		{
+			Keys: bsonx.Doc{{Key: "importstatus", Value: bsonx.Int32(1)}, {Key: "nextimportat", Value: bsonx.Int32(1)}},
+		},
 	}
 	_, err := mgm.Coll(&PortalAddressData{}).Indexes().CreateMany(ctx, coinMdl)
 	if err != nil {
@@ -99,15 +102,514 @@ func DBGetPortalAddressesByTimestamp(fromTimeStamp int64, toTimeStamp int64) ([]
 	return list, nil
 }
 
-func DBGetBTCAddressByIncAddress(incAddress string) (string, error) {
+func DBGetPortalAddressesByIncAddresses(incAddresses []string) ([]PortalAddressData, error) {
 	startTime := time.Now()
+	list := []PortalAddressData{}
+	filter := bson.M{"incaddress": bson.M{operator.In: incAddresses}}
+
+	err := mgm.Coll(&PortalAddressData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("get %v btc addresses by %v inc addresses in %v", len(list), len(incAddresses), time.Since(startTime))
+	return list, nil
+}
 
-	filter := bson.M{"incaddress": bson.M{operator.Eq: incAddress}}
+func DBGetPortalAddressByBTCAddress(btcAddress string) (*PortalAddressData, error) {
+	filter := bson.M{"btcaddress": bson.M{operator.Eq: btcAddress}}
 	var result PortalAddressData
 	err := mgm.Coll(&PortalAddressData{}).First(filter, &result)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return &result, nil
+}
+
+func DBUpdatePortalAddress(item *PortalAddressData) error {
+	return mgm.Coll(&PortalAddressData{}).Update(item)
+}
+
+// DBGetPendingPortalAddressImports returns up to limit addresses waiting to be imported whose
+// next attempt is due at timestamp
+func DBGetPendingPortalAddressImports(timestamp int64, limit int64) ([]PortalAddressData, error) {
+	list := []PortalAddressData{}
+	filter := bson.M{"importstatus": bson.M{operator.Eq: ImportStatusPending}, "nextimportat": bson.M{operator.Lte: timestamp}}
+
+	// newest registrations first so a batch holds addresses of similar age to rescan for
+	sortOrder := bson.D{{Key: "nextimportat", Value: 1}, {Key: "timestamp", Value: -1}}
+	err := mgm.Coll(&PortalAddressData{}).SimpleFind(&list, filter, options.Find().SetSort(sortOrder).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DBMigrateLegacyPortalAddressImports marks the addresses saved before imports were tracked as
+// imported into node, which they were imported into at registration, returning how many changed
+func DBMigrateLegacyPortalAddressImports(node string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	// the field is missing from records saved before it was added
+	filter := bson.M{"importstatus": bson.M{operator.In: bson.A{"", nil}}}
+	update := bson.M{operator.Set: bson.M{
+		"importstatus":  ImportStatusImported,
+		"importednodes": []string{node},
+		"nextimportat":  0,
+		"updated_at":    time.Now().UTC(),
+	}}
+	result, err := mgm.Coll(&PortalAddressData{}).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// DBRequeuePortalAddressImports queues for import at timestamp the addresses missing from any of
+// nodes, e.g. nodes added since the addresses were imported, returning how many changed
+func DBRequeuePortalAddressImports(nodes []string, timestamp int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	filter := bson.M{
+		"importednodes": bson.M{operator.Not: bson.M{operator.All: nodes}},
+		"importstatus":  bson.M{operator.Ne: ImportStatusPending},
+	}
+	update := bson.M{operator.Set: bson.M{
+		"importstatus":   ImportStatusPending,
+		"importattempts": 0,
+		"nextimportat":   timestamp,
+		"updated_at":     time.Now().UTC(),
+	}}
+	result, err := mgm.Coll(&PortalAddressData{}).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func DBGetPortalAddressesByBTCAddresses(btcAddresses []string) ([]PortalAddressData, error) {
+	list := []PortalAddressData{}
+	filter := bson.M{"btcaddress": bson.M{operator.In: btcAddresses}}
+
+	err := mgm.Coll(&PortalAddressData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func DBCreatePortalDepositIndex() error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	depositMdl := []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{Key: "externaltxid", Value: bsonx.Int32(1)}, {Key: "vout", Value: bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{Key: "incaddress", Value: bsonx.Int32(1)}},
+		},
+		{
+			Keys: bsonx.Doc{{Key: "btcaddress", Value: bsonx.Int32(1)}},
+		},
+	}
+	_, err := mgm.Coll(&PortalDepositData{}).Indexes().CreateMany(ctx, depositMdl)
+	if err != nil {
+		log.Printf("failed to index portal deposits in %v", time.Since(startTime))
+		return err
+	}
+
+	log.Printf("success index portal deposits in %v", time.Since(startTime))
+	return nil
+}
+
+// DBSavePortalDeposit inserts the deposit or updates the block it was included in,
+// a deposit orphaned by a reorg becomes valid again once it is mined in the main chain
+func DBSavePortalDeposit(item PortalDepositData) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	curTime := time.Now().UTC()
+	filter := bson.M{"externaltxid": bson.M{operator.Eq: item.ExternalTxID}, "vout": bson.M{operator.Eq: item.Vout}}
+	update := bson.M{
+		operator.Set: bson.M{
+			"incaddress":  item.IncAddress,
+			"btcaddress":  item.BTCAddress,
+			"amount":      item.Amount,
+			"blockhash":   item.BlockHash,
+			"blockheight": item.BlockHeight,
+			"blocktime":   item.BlockTime,
+			"orphaned":    false,
+			"updated_at":  curTime,
+		},
+		operator.SetOnInsert: bson.M{"created_at": curTime},
+	}
+	_, err := mgm.Coll(&PortalDepositData{}).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("failed to save portal deposit %v:%v in %v", item.ExternalTxID, item.Vout, time.Since(startTime))
+		return err
+	}
+	return nil
+}
+
+// DBInsertPortalDeposit records a deposit unless it is already recorded, leaving updates of
+// recorded deposits, e.g. on reorgs, to the block scanner
+func DBInsertPortalDeposit(item PortalDepositData) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	curTime := time.Now().UTC()
+	filter := bson.M{"externaltxid": bson.M{operator.Eq: item.ExternalTxID}, "vout": bson.M{operator.Eq: item.Vout}}
+	update := bson.M{
+		operator.SetOnInsert: bson.M{
+			"incaddress":  item.IncAddress,
+			"btcaddress":  item.BTCAddress,
+			"amount":      item.Amount,
+			"blockhash":   item.BlockHash,
+			"blockheight": item.BlockHeight,
+			"blocktime":   item.BlockTime,
+			"orphaned":    false,
+			"created_at":  curTime,
+			"updated_at":  curTime,
+		},
+	}
+	_, err := mgm.Coll(&PortalDepositData{}).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("failed to insert portal deposit %v:%v in %v", item.ExternalTxID, item.Vout, time.Since(startTime))
+		return err
+	}
+	return nil
+}
+
+func DBGetPortalDepositsByIncAddresses(incAddresses []string) ([]PortalDepositData, error) {
+	startTime := time.Now()
+	list := []PortalDepositData{}
+	filter := bson.M{"incaddress": bson.M{operator.In: incAddresses}}
+
+	err := mgm.Coll(&PortalDepositData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("found %v deposits of %v inc addresses in %v", len(list), len(incAddresses), time.Since(startTime))
+
+	return list, nil
+}
+
+// DBGetUnorphanedPortalDeposits returns the deposits whose block is in the main chain
+func DBGetUnorphanedPortalDeposits() ([]PortalDepositData, error) {
+	list := []PortalDepositData{}
+	filter := bson.M{"orphaned": bson.M{operator.Eq: false}}
+
+	err := mgm.Coll(&PortalDepositData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DBGetCheckpoint returns nil if the worker has never saved a checkpoint
+func DBGetCheckpoint(name string) (*PortalCheckpointData, error) {
+	filter := bson.M{"name": bson.M{operator.Eq: name}}
+	var result PortalCheckpointData
+	err := mgm.Coll(&PortalCheckpointData{}).First(filter, &result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+func DBSaveCheckpoint(name string, blockHash string, blockHeight int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	curTime := time.Now().UTC()
+	filter := bson.M{"name": bson.M{operator.Eq: name}}
+	update := bson.M{
+		operator.Set: bson.M{
+			"blockhash":   blockHash,
+			"blockheight": blockHeight,
+			"updated_at":  curTime,
+		},
+		operator.SetOnInsert: bson.M{"created_at": curTime},
+	}
+	_, err := mgm.Coll(&PortalCheckpointData{}).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func DBGetAllPortalAddresses() ([]PortalAddressData, error) {
+	list := []PortalAddressData{}
+	err := mgm.Coll(&PortalAddressData{}).SimpleFind(&list, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DBMarkPortalDepositsOrphaned marks deposits matching filter as orphaned, returning how many changed
+func DBMarkPortalDepositsOrphaned(filter bson.M) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	filter["orphaned"] = bson.M{operator.Eq: false}
+	update := bson.M{operator.Set: bson.M{"orphaned": true, "updated_at": time.Now().UTC()}}
+	result, err := mgm.Coll(&PortalDepositData{}).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func DBMarkPortalDepositsOrphanedFromHeight(blockHeight int64) (int64, error) {
+	return DBMarkPortalDepositsOrphaned(bson.M{"blockheight": bson.M{operator.Gte: blockHeight}})
+}
+
+func DBMarkPortalDepositsOrphanedByBlockHash(blockHash string) (int64, error) {
+	return DBMarkPortalDepositsOrphaned(bson.M{"blockhash": bson.M{operator.Eq: blockHash}})
+}
+
+// DBGetRecentPortalDepositBlocks returns the distinct height/hash pairs of non-orphaned deposits from fromHeight
+func DBGetRecentPortalDepositBlocks(fromHeight int64) ([]PortalScannedBlockData, error) {
+	list := []PortalDepositData{}
+	filter := bson.M{"blockheight": bson.M{operator.Gte: fromHeight}, "orphaned": bson.M{operator.Eq: false}}
+	err := mgm.Coll(&PortalDepositData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
 	}
-	log.Printf("get btc address by inc address in %v", time.Since(startTime))
-	return result.BTCAddress, nil
+
+	blocks := []PortalScannedBlockData{}
+	seen := map[string]bool{}
+	for _, d := range list {
+		if seen[d.BlockHash] {
+			continue
+		}
+		seen[d.BlockHash] = true
+		blocks = append(blocks, PortalScannedBlockData{BlockHeight: d.BlockHeight, BlockHash: d.BlockHash})
+	}
+	return blocks, nil
+}
+
+func DBCreateScannedBlockIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	blockMdl := []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{Key: "blockheight", Value: bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+	_, err := mgm.Coll(&PortalScannedBlockData{}).Indexes().CreateMany(ctx, blockMdl)
+	return err
+}
+
+func DBSaveScannedBlock(blockHeight int64, blockHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	curTime := time.Now().UTC()
+	filter := bson.M{"blockheight": bson.M{operator.Eq: blockHeight}}
+	update := bson.M{
+		operator.Set: bson.M{
+			"blockhash":  blockHash,
+			"updated_at": curTime,
+		},
+		operator.SetOnInsert: bson.M{"created_at": curTime},
+	}
+	_, err := mgm.Coll(&PortalScannedBlockData{}).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// DBGetScannedBlock returns nil if the block at blockHeight has not been scanned or was pruned
+func DBGetScannedBlock(blockHeight int64) (*PortalScannedBlockData, error) {
+	filter := bson.M{"blockheight": bson.M{operator.Eq: blockHeight}}
+	var result PortalScannedBlockData
+	err := mgm.Coll(&PortalScannedBlockData{}).First(filter, &result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DBDeleteScannedBlocksOutside removes scanned blocks below fromHeight (pruning) or above toHeight (rollback)
+func DBDeleteScannedBlocksOutside(fromHeight int64, toHeight int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	filter := bson.M{operator.Or: []bson.M{
+		{"blockheight": bson.M{operator.Lt: fromHeight}},
+		{"blockheight": bson.M{operator.Gt: toHeight}},
+	}}
+	_, err := mgm.Coll(&PortalScannedBlockData{}).DeleteMany(ctx, filter)
+	return err
+}
+
+func DBCreatePortalShieldRequestIndex() error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	shieldRequestMdl := []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{Key: "reqtxid", Value: bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{Key: "externaltxid", Value: bsonx.Int32(1)}},
+		},
+	}
+	_, err := mgm.Coll(&PortalShieldRequestData{}).Indexes().CreateMany(ctx, shieldRequestMdl)
+	if err != nil {
+		log.Printf("failed to index portal shield requests in %v", time.Since(startTime))
+		return err
+	}
+
+	log.Printf("success index portal shield requests in %v", time.Since(startTime))
+	return nil
+}
+
+func DBCheckPortalShieldRequestExisted(reqTxID string) (bool, error) {
+	filter := bson.M{"reqtxid": bson.M{operator.Eq: reqTxID}}
+	var result PortalShieldRequestData
+	err := mgm.Coll(&PortalShieldRequestData{}).First(filter, &result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func DBSavePortalShieldRequest(item PortalShieldRequestData) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	err := item.Creating()
+	if err != nil {
+		return err
+	}
+	_, err = mgm.Coll(&PortalShieldRequestData{}).InsertOne(ctx, item)
+	if err != nil {
+		log.Printf("failed to insert portal shield request %v in %v", item, time.Since(startTime))
+		return err
+	}
+
+	log.Printf("inserted portal shield request %v in %v", item, time.Since(startTime))
+	return nil
+}
+
+func DBGetPortalShieldRequestsByExternalTxID(externalTxID string) ([]PortalShieldRequestData, error) {
+	list := []PortalShieldRequestData{}
+	filter := bson.M{"externaltxid": bson.M{operator.Eq: externalTxID}}
+
+	err := mgm.Coll(&PortalShieldRequestData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func DBCreatePortalUnshieldIndex() error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	unshieldMdl := []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{Key: "unshieldid", Value: bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{Key: "incaddress", Value: bsonx.Int32(1)}, {Key: "tokenid", Value: bsonx.Int32(1)}},
+		},
+		{
+			Keys: bsonx.Doc{{Key: "status", Value: bsonx.Int32(1)}},
+		},
+	}
+	_, err := mgm.Coll(&PortalUnshieldData{}).Indexes().CreateMany(ctx, unshieldMdl)
+	if err != nil {
+		log.Printf("failed to index portal unshields in %v", time.Since(startTime))
+		return err
+	}
+
+	log.Printf("success index portal unshields in %v", time.Since(startTime))
+	return nil
+}
+
+func DBCheckPortalUnshieldExisted(unshieldID string) (bool, error) {
+	filter := bson.M{"unshieldid": bson.M{operator.Eq: unshieldID}}
+	var result PortalUnshieldData
+	err := mgm.Coll(&PortalUnshieldData{}).First(filter, &result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func DBSavePortalUnshield(item PortalUnshieldData) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*DB_OPERATION_TIMEOUT)
+	defer cancel()
+
+	err := item.Creating()
+	if err != nil {
+		return err
+	}
+	_, err = mgm.Coll(&PortalUnshieldData{}).InsertOne(ctx, item)
+	if err != nil {
+		log.Printf("failed to insert portal unshield %v in %v", item, time.Since(startTime))
+		return err
+	}
+
+	log.Printf("inserted portal unshield %v in %v", item, time.Since(startTime))
+	return nil
+}
+
+func DBUpdatePortalUnshield(item *PortalUnshieldData) error {
+	return mgm.Coll(&PortalUnshieldData{}).Update(item)
+}
+
+func DBDeletePortalUnshield(item *PortalUnshieldData) error {
+	return mgm.Coll(&PortalUnshieldData{}).Delete(item)
+}
+
+func DBGetPortalUnshieldsByIncAddress(incAddress string, tokenID string) ([]PortalUnshieldData, error) {
+	startTime := time.Now()
+	list := []PortalUnshieldData{}
+	filter := bson.M{"incaddress": bson.M{operator.Eq: incAddress}, "tokenid": bson.M{operator.Eq: tokenID}}
+
+	err := mgm.Coll(&PortalUnshieldData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("found %v unshields of %v in %v", len(list), incAddress, time.Since(startTime))
+
+	return list, nil
+}
+
+// DBGetUnfinishedPortalUnshields returns unshields whose BTC transaction has not been confirmed yet
+func DBGetUnfinishedPortalUnshields() ([]PortalUnshieldData, error) {
+	list := []PortalUnshieldData{}
+	filter := bson.M{"status": bson.M{operator.In: []int{UnshieldStatusPending, UnshieldStatusProcessing}}}
+
+	err := mgm.Coll(&PortalUnshieldData{}).SimpleFind(&list, filter)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
 }
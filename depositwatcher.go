@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type listSinceBlockTransaction struct {
+	Address       string  `json:"address"`
+	Category      string  `json:"category"`
+	Amount        float64 `json:"amount"`
+	Vout          uint32  `json:"vout"`
+	Confirmations int64   `json:"confirmations"`
+	BlockHash     string  `json:"blockhash"`
+	BlockTime     int64   `json:"blocktime"`
+	TxID          string  `json:"txid"`
+}
+
+type listSinceBlockResult struct {
+	Transactions []listSinceBlockTransaction `json:"transactions"`
+	LastBlock    string                      `json:"lastblock"`
+}
+
+// startDepositWatcher backfills the deposit ledger from the bitcoind wallets, they know the
+// deposits made to imported addresses in blocks the block scanner has not walked, e.g. before
+// its start height
+func startDepositWatcher() {
+	backend, ok := btcBackend.(*bitcoindBackend)
+	if !ok {
+		return
+	}
+	log.Println("starting deposit watcher...")
+	for {
+		for _, node := range backend.nodes {
+			if !node.isHealthy() {
+				continue
+			}
+			err := watchDeposits(backend, node)
+			if err != nil {
+				log.Printf("Could not watch deposits of bitcoind node %v - Error %v\n", node.config.Name, err)
+			}
+		}
+		time.Sleep(DepositWatcherInterval)
+	}
+}
+
+// watchDeposits records every confirmed transaction received by a registered address since the
+// last checkpoint of node into the deposit ledger. Deposits already recorded are left to the block
+// scanner, and those in blocks off the main chain of the backend are skipped, so a node still on
+// an old fork does not bring orphaned deposits back
+func watchDeposits(backend *bitcoindBackend, node *bitcoindNode) error {
+	checkpointName := DepositWatcherCheckpoint + ":" + node.config.Name
+	checkpoint, err := DBGetCheckpoint(checkpointName)
+	if err != nil {
+		return err
+	}
+	sinceBlock := ""
+	if checkpoint != nil {
+		sinceBlock = checkpoint.BlockHash
+	}
+
+	result, err := node.listSinceBlock(sinceBlock)
+	if err != nil {
+		return err
+	}
+
+	blockHeights := map[string]int64{}
+	onMainChain := map[string]bool{}
+	for _, tx := range result.Transactions {
+		if tx.Category != "receive" || tx.Confirmations < 1 {
+			continue
+		}
+		addressData, err := DBGetPortalAddressByBTCAddress(tx.Address)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				// not a shielding address, e.g. change of the portal
+				continue
+			}
+			return err
+		}
+		height, ok := blockHeights[tx.BlockHash]
+		if !ok {
+			height, err = node.getBlockHeight(tx.BlockHash)
+			if err != nil {
+				return err
+			}
+			blockHeights[tx.BlockHash] = height
+			mainChainHash, err := backend.GetBlockHash(height)
+			if err != nil {
+				return err
+			}
+			onMainChain[tx.BlockHash] = mainChainHash.String() == tx.BlockHash
+		}
+		if !onMainChain[tx.BlockHash] {
+			continue
+		}
+		amount, err := btcutil.NewAmount(tx.Amount)
+		if err != nil {
+			return err
+		}
+
+		item := NewPortalDepositData(addressData.IncAddress, tx.Address, tx.TxID, tx.Vout, int64(amount), tx.BlockHash, height, tx.BlockTime)
+		err = DBInsertPortalDeposit(*item)
+		if err != nil {
+			return err
+		}
+	}
+
+	lastHeight, err := node.getBlockHeight(result.LastBlock)
+	if err != nil {
+		return err
+	}
+	return DBSaveCheckpoint(checkpointName, result.LastBlock, lastHeight)
+}
+
+func (n *bitcoindNode) listSinceBlock(blockHash string) (*listSinceBlockResult, error) {
+	// watch-only transactions must be included as portal addresses are imported without keys
+	response, err := n.rawRequest("listsinceblock", blockHash, 1, true)
+	if err != nil {
+		return nil, err
+	}
+	var result listSinceBlockResult
+	err = json.Unmarshal(response, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (n *bitcoindNode) getBlockHeight(blockHashStr string) (int64, error) {
+	blockHash, err := chainhash.NewHashFromStr(blockHashStr)
+	if err != nil {
+		return 0, err
+	}
+	var header btcjson.GetBlockHeaderVerboseResult
+	err = n.rawRequestInto(&header, "getblockheader", blockHash.String(), true)
+	if err != nil {
+		return 0, err
+	}
+	return int64(header.Height), nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// electrumBackend talks the Electrum protocol (newline delimited JSON-RPC over TCP) to an
+// Electrum server, which indexes every script so nothing has to be imported. Electrum servers
+// do not serve full blocks so the block scanner does not run on this backend
+type electrumBackend struct {
+	address    string
+	useTLS     bool
+	skipVerify bool
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+type electrumRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type electrumResponse struct {
+	ID     *int               `json:"id"`
+	Result stdjson.RawMessage `json:"result"`
+	Error  stdjson.RawMessage `json:"error"`
+}
+
+type electrumUnspent struct {
+	TxHash string `json:"tx_hash"`
+	TxPos  uint32 `json:"tx_pos"`
+	Height int64  `json:"height"`
+	Value  int64  `json:"value"`
+}
+
+type electrumHistoryItem struct {
+	TxHash string `json:"tx_hash"`
+	Height int64  `json:"height"`
+}
+
+type electrumHeader struct {
+	Height int64  `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+func newElectrumBackend(address string, useTLS bool, skipVerify bool) *electrumBackend {
+	return &electrumBackend{address: address, useTLS: useTLS, skipVerify: skipVerify}
+}
+
+func (b *electrumBackend) connect() error {
+	dialer := &net.Dialer{Timeout: BTCBackendTimeout}
+	var conn net.Conn
+	var err error
+	if b.useTLS {
+		// many Electrum servers use self-signed certificates
+		conn, err = tls.DialWithDialer(dialer, "tcp", b.address, &tls.Config{InsecureSkipVerify: b.skipVerify})
+	} else {
+		conn, err = dialer.Dial("tcp", b.address)
+	}
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.reader = bufio.NewReader(conn)
+	return nil
+}
+
+func (b *electrumBackend) close() {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.conn = nil
+	b.reader = nil
+}
+
+// call sends one request and waits for its response, requests are serialized on a single
+// connection which is reopened on the next call after any failure
+func (b *electrumBackend) call(method string, params []interface{}, result interface{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.conn == nil {
+		err := b.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	b.nextID++
+	request, err := json.Marshal(electrumRequest{JSONRPC: "2.0", ID: b.nextID, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	err = b.conn.SetDeadline(time.Now().Add(BTCBackendTimeout))
+	if err == nil {
+		_, err = b.conn.Write(append(request, '\n'))
+	}
+	if err != nil {
+		b.close()
+		return err
+	}
+
+	for {
+		line, err := b.reader.ReadBytes('\n')
+		if err != nil {
+			b.close()
+			return err
+		}
+		var response electrumResponse
+		err = json.Unmarshal(line, &response)
+		if err != nil {
+			b.close()
+			return fmt.Errorf("Could not parse response: %v", string(line))
+		}
+		if response.ID == nil || *response.ID != b.nextID {
+			// a notification or the response of a timed out request
+			continue
+		}
+		if len(response.Error) > 0 && string(response.Error) != "null" {
+			return fmt.Errorf("%v", string(response.Error))
+		}
+		return json.Unmarshal(response.Result, result)
+	}
+}
+
+// getScriptHash returns the Electrum script hash of address, the reversed sha256 of its script
+func getScriptHash(address string) (string, error) {
+	btcAddress, err := btcutil.DecodeAddress(address, BTCChainCfg)
+	if err != nil {
+		return "", err
+	}
+	script, err := txscript.PayToAddrScript(btcAddress)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(script)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (b *electrumBackend) Name() string {
+	return BTCBackendElectrum
+}
+
+func (b *electrumBackend) ImportNodes() []string {
+	return nil
+}
+
+func (b *electrumBackend) ImportAddresses(node string, addresses []string, since int64) []error {
+	return make([]error, len(addresses))
+}
+
+func (b *electrumBackend) ListUTXOs(addresses []string, minConf int64) ([]BTCUTXO, error) {
+	tipHeight, err := b.GetTipHeight()
+	if err != nil {
+		return nil, err
+	}
+	utxos := []BTCUTXO{}
+	for _, address := range addresses {
+		scriptHash, err := getScriptHash(address)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode address %v - with err: %v", address, err)
+		}
+		var unspents []electrumUnspent
+		err = b.call("blockchain.scripthash.listunspent", []interface{}{scriptHash}, &unspents)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get utxos of address %v - with err: %v", address, err)
+		}
+		for _, u := range unspents {
+			// mempool transactions have a height of 0 or -1
+			confirmations := getConfirmationsFromHeight(u.Height, tipHeight)
+			if confirmations < minConf {
+				continue
+			}
+			utxos = append(utxos, BTCUTXO{
+				TxID:          u.TxHash,
+				Vout:          u.TxPos,
+				Address:       address,
+				Amount:        u.Value,
+				Confirmations: confirmations,
+			})
+		}
+	}
+	return utxos, nil
+}
+
+// getTxHeight finds the height of a transaction in the history of the scripts it pays,
+// Electrum servers have no lookup by transaction id
+func (b *electrumBackend) getTxHeight(txID string, msgTx *wire.MsgTx) (int64, error) {
+	for _, out := range msgTx.TxOut {
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, BTCChainCfg)
+		if err != nil || len(addresses) != 1 {
+			continue
+		}
+		scriptHash, err := getScriptHash(addresses[0].EncodeAddress())
+		if err != nil {
+			continue
+		}
+		var history []electrumHistoryItem
+		err = b.call("blockchain.scripthash.get_history", []interface{}{scriptHash}, &history)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range history {
+			if item.TxHash == txID {
+				return item.Height, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func (b *electrumBackend) getBlockHeader(height int64) (*wire.BlockHeader, error) {
+	var headerHex string
+	err := b.call("blockchain.block.header", []interface{}{height}, &headerHex)
+	if err != nil {
+		return nil, err
+	}
+	headerBytes, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return nil, err
+	}
+	var header wire.BlockHeader
+	err = header.Deserialize(bytes.NewReader(headerBytes))
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func (b *electrumBackend) GetTx(txID string) (*BTCTx, error) {
+	var txHex string
+	err := b.call("blockchain.transaction.get", []interface{}{txID, false}, &txHex)
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	var msgTx wire.MsgTx
+	err = msgTx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &BTCTx{TxID: txID, MsgTx: &msgTx}
+	height, err := b.getTxHeight(txID, &msgTx)
+	if err != nil {
+		return nil, err
+	}
+	if height > 0 {
+		tipHeight, err := b.GetTipHeight()
+		if err != nil {
+			return nil, err
+		}
+		header, err := b.getBlockHeader(height)
+		if err != nil {
+			return nil, err
+		}
+		tx.BlockHash = header.BlockHash().String()
+		tx.BlockHeight = height
+		tx.BlockTime = header.Timestamp.Unix()
+		tx.Confirmations = getConfirmationsFromHeight(height, tipHeight)
+	}
+	return tx, nil
+}
+
+// GetTxTimes returns the block time of each transaction, Electrum servers do not tell when
+// unconfirmed transactions were first seen so their time is 0
+func (b *electrumBackend) GetTxTimes(txIDs []string) (map[string]BTCTxTime, map[string]error) {
+	times := map[string]BTCTxTime{}
+	errs := map[string]error{}
+	for _, txID := range txIDs {
+		tx, err := b.GetTx(txID)
+		if err != nil {
+			errs[txID] = err
+			continue
+		}
+		times[txID] = BTCTxTime{Time: tx.BlockTime, Confirmed: tx.Confirmations > 0}
+	}
+	return times, errs
+}
+
+func (b *electrumBackend) GetTipHeight() (int64, error) {
+	var header electrumHeader
+	err := b.call("blockchain.headers.subscribe", []interface{}{}, &header)
+	if err != nil {
+		return 0, err
+	}
+	return header.Height, nil
+}
+
+func (b *electrumBackend) Broadcast(txHex string) (string, error) {
+	var txID string
+	err := b.call("blockchain.transaction.broadcast", []interface{}{txHex}, &txID)
+	if err != nil {
+		return "", err
+	}
+	return txID, nil
+}
+
+func (b *electrumBackend) EstimateFee(confTarget int) (float64, error) {
+	var feeRate float64 // in BTC/kvB
+	err := b.call("blockchain.estimatefee", []interface{}{confTarget}, &feeRate)
+	if err != nil {
+		return 0, err
+	}
+	if feeRate <= 0 {
+		return 0, fmt.Errorf("No fee estimate for target %v", confTarget)
+	}
+	return feeRate * 1e8 / 1000, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// newElectrumStub serves the Electrum line protocol on a local port, handle returns the
+// messages written back for each request
+func newElectrumStub(t *testing.T, handle func(request electrumRequest) []interface{}) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveElectrumConn(conn, handle)
+		}
+	}()
+	return listener
+}
+
+func serveElectrumConn(conn net.Conn, handle func(request electrumRequest) []interface{}) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var request electrumRequest
+		err = stdjson.Unmarshal(line, &request)
+		if err != nil {
+			return
+		}
+		for _, message := range handle(request) {
+			out, _ := stdjson.Marshal(message)
+			conn.Write(append(out, '\n'))
+		}
+	}
+}
+
+func electrumReply(id int, result interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result}
+}
+
+func newTestAddress(t *testing.T, seed byte) btcutil.Address {
+	address, err := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{seed}, 20), BTCChainCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+func TestElectrumCallSkipsNotifications(t *testing.T) {
+	listener := newElectrumStub(t, func(request electrumRequest) []interface{} {
+		switch request.Method {
+		case "server.ping":
+			return []interface{}{
+				map[string]interface{}{"jsonrpc": "2.0", "method": "blockchain.headers.subscribe", "params": []interface{}{}},
+				electrumReply(request.ID-1, "stale"),
+				electrumReply(request.ID, "pong"),
+			}
+		default:
+			return []interface{}{map[string]interface{}{
+				"jsonrpc": "2.0", "id": request.ID, "error": map[string]interface{}{"code": -32601, "message": "unknown method"},
+			}}
+		}
+	})
+	defer listener.Close()
+	backend := newElectrumBackend(listener.Addr().String(), false, false)
+
+	for i := 0; i < 2; i++ {
+		var result string
+		err := backend.call("server.ping", []interface{}{}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "pong" {
+			t.Errorf("call %v returned %v, want the response with its own id", i, result)
+		}
+	}
+
+	var result string
+	err := backend.call("server.unknown", []interface{}{}, &result)
+	if err == nil {
+		t.Errorf("an error response did not fail the call")
+	}
+	// the connection stays usable after an error response
+	err = backend.call("server.ping", []interface{}{}, &result)
+	if err != nil || result != "pong" {
+		t.Errorf("call after an error response returned %v, %v", result, err)
+	}
+}
+
+func TestElectrumListUTXOs(t *testing.T) {
+	BTCChainCfg = &chaincfg.RegressionNetParams
+	address := newTestAddress(t, 1).EncodeAddress()
+	scriptHash, err := getScriptHash(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newElectrumStub(t, func(request electrumRequest) []interface{} {
+		switch request.Method {
+		case "blockchain.headers.subscribe":
+			return []interface{}{electrumReply(request.ID, map[string]interface{}{"height": 100, "hex": ""})}
+		case "blockchain.scripthash.listunspent":
+			if request.Params[0] != scriptHash {
+				return []interface{}{electrumReply(request.ID, []interface{}{})}
+			}
+			return []interface{}{electrumReply(request.ID, []interface{}{
+				map[string]interface{}{"tx_hash": "tip", "tx_pos": 0, "height": 100, "value": 1000},
+				map[string]interface{}{"tx_hash": "deep", "tx_pos": 1, "height": 91, "value": 2000},
+				map[string]interface{}{"tx_hash": "mempool", "tx_pos": 0, "height": 0, "value": 3000},
+				map[string]interface{}{"tx_hash": "unconfirmed-parent", "tx_pos": 0, "height": -1, "value": 4000},
+			})}
+		}
+		return nil
+	})
+	defer listener.Close()
+	backend := newElectrumBackend(listener.Addr().String(), false, false)
+
+	utxos, err := backend.ListUTXOs([]string{address}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"tip": 1, "deep": 10, "mempool": 0, "unconfirmed-parent": 0}
+	if len(utxos) != len(want) {
+		t.Fatalf("got %v utxos, want %v", len(utxos), len(want))
+	}
+	for _, u := range utxos {
+		if u.Confirmations != want[u.TxID] || u.Address != address {
+			t.Errorf("utxo %v of %v has %v confirmations, want %v", u.TxID, u.Address, u.Confirmations, want[u.TxID])
+		}
+	}
+
+	utxos, err = backend.ListUTXOs([]string{address}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].TxID != "deep" || utxos[0].Vout != 1 || utxos[0].Amount != 2000 {
+		t.Errorf("got utxos %+v, want only deep", utxos)
+	}
+}
+
+func TestElectrumGetTx(t *testing.T) {
+	BTCChainCfg = &chaincfg.RegressionNetParams
+	pkScript, err := txscript.PayToAddrScript(newTestAddress(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx, txHex := newTestTxHex(t, pkScript)
+	txID := msgTx.TxHash().String()
+	header := wire.NewBlockHeader(1, &chainhash.Hash{3}, &chainhash.Hash{4}, 0x207fffff, 7)
+	header.Timestamp = time.Unix(1600000000, 0)
+	var headerBuf bytes.Buffer
+	err = header.Serialize(&headerBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := newElectrumStub(t, func(request electrumRequest) []interface{} {
+		switch request.Method {
+		case "blockchain.headers.subscribe":
+			return []interface{}{electrumReply(request.ID, map[string]interface{}{"height": 100, "hex": ""})}
+		case "blockchain.transaction.get":
+			return []interface{}{electrumReply(request.ID, txHex)}
+		case "blockchain.scripthash.get_history":
+			return []interface{}{electrumReply(request.ID, []interface{}{
+				map[string]interface{}{"tx_hash": (&chainhash.Hash{5}).String(), "height": 50},
+				map[string]interface{}{"tx_hash": txID, "height": 95},
+			})}
+		case "blockchain.block.header":
+			if request.Params[0] != float64(95) {
+				return []interface{}{electrumReply(request.ID, "")}
+			}
+			return []interface{}{electrumReply(request.ID, hex.EncodeToString(headerBuf.Bytes()))}
+		}
+		return nil
+	})
+	defer listener.Close()
+	backend := newElectrumBackend(listener.Addr().String(), false, false)
+
+	tx, err := backend.GetTx(txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.BlockHeight != 95 || tx.Confirmations != 6 {
+		t.Errorf("got height %v with %v confirmations, want 95 with 6", tx.BlockHeight, tx.Confirmations)
+	}
+	if tx.BlockHash != header.BlockHash().String() || tx.BlockTime != 1600000000 {
+		t.Errorf("got block %v at %v, want %v", tx.BlockHash, tx.BlockTime, header.BlockHash())
+	}
+	if tx.MsgTx.TxHash().String() != txID {
+		t.Errorf("decoded transaction %v, want %v", tx.MsgTx.TxHash(), txID)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	resty "github.com/go-resty/resty/v2"
+)
+
+// esploraBackend reads the chain from an Esplora HTTP API, which indexes every address
+// so nothing has to be imported
+type esploraBackend struct {
+	url    string
+	client *resty.Client
+}
+
+type esploraTxStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight int64  `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+	BlockTime   int64  `json:"block_time"`
+}
+
+type esploraUTXO struct {
+	TxID   string          `json:"txid"`
+	Vout   uint32          `json:"vout"`
+	Value  int64           `json:"value"`
+	Status esploraTxStatus `json:"status"`
+}
+
+type esploraTx struct {
+	TxID   string          `json:"txid"`
+	Status esploraTxStatus `json:"status"`
+}
+
+func newEsploraBackend(url string) *esploraBackend {
+	return &esploraBackend{
+		url:    strings.TrimSuffix(url, "/"),
+		client: resty.New().SetTimeout(BTCBackendTimeout),
+	}
+}
+
+func (b *esploraBackend) get(path string) ([]byte, error) {
+	response, err := b.client.R().Get(b.url + path)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode() != 200 {
+		return nil, fmt.Errorf("Response status code: %v - %v", response.StatusCode(), strings.TrimSpace(response.String()))
+	}
+	return response.Body(), nil
+}
+
+func (b *esploraBackend) Name() string {
+	return BTCBackendEsplora
+}
+
+func (b *esploraBackend) ImportNodes() []string {
+	return nil
+}
+
+func (b *esploraBackend) ImportAddresses(node string, addresses []string, since int64) []error {
+	return make([]error, len(addresses))
+}
+
+func (b *esploraBackend) ListUTXOs(addresses []string, minConf int64) ([]BTCUTXO, error) {
+	tipHeight, err := b.GetTipHeight()
+	if err != nil {
+		return nil, err
+	}
+	utxosList := make([][]BTCUTXO, len(addresses))
+	errs := make([]error, len(addresses))
+	runBounded(len(addresses), serviceCfg.MaxConcurrentRPC, func(i int) {
+		body, err := b.get(fmt.Sprintf("/address/%v/utxo", addresses[i]))
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		var unspents []esploraUTXO
+		err = json.Unmarshal(body, &unspents)
+		if err != nil {
+			errs[i] = fmt.Errorf("Could not parse response: %v", string(body))
+			return
+		}
+		for _, u := range unspents {
+			confirmations := int64(0)
+			if u.Status.Confirmed {
+				confirmations = getConfirmationsFromHeight(u.Status.BlockHeight, tipHeight)
+			}
+			if confirmations < minConf {
+				continue
+			}
+			utxosList[i] = append(utxosList[i], BTCUTXO{
+				TxID:          u.TxID,
+				Vout:          u.Vout,
+				Address:       addresses[i],
+				Amount:        u.Value,
+				Confirmations: confirmations,
+			})
+		}
+	})
+
+	utxos := []BTCUTXO{}
+	for i := range addresses {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("Could not get utxos of address %v - with err: %v", addresses[i], errs[i])
+		}
+		utxos = append(utxos, utxosList[i]...)
+	}
+	return utxos, nil
+}
+
+func (b *esploraBackend) getTxStatus(txID string) (*esploraTx, error) {
+	body, err := b.get(fmt.Sprintf("/tx/%v", txID))
+	if err != nil {
+		return nil, err
+	}
+	var tx esploraTx
+	err = json.Unmarshal(body, &tx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse response: %v", string(body))
+	}
+	return &tx, nil
+}
+
+func (b *esploraBackend) GetTx(txID string) (*BTCTx, error) {
+	txStatus, err := b.getTxStatus(txID)
+	if err != nil {
+		return nil, err
+	}
+	body, err := b.get(fmt.Sprintf("/tx/%v/hex", txID))
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	var msgTx wire.MsgTx
+	err = msgTx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &BTCTx{TxID: txID, MsgTx: &msgTx}
+	if txStatus.Status.Confirmed {
+		tipHeight, err := b.GetTipHeight()
+		if err != nil {
+			return nil, err
+		}
+		tx.BlockHash = txStatus.Status.BlockHash
+		tx.BlockHeight = txStatus.Status.BlockHeight
+		tx.BlockTime = txStatus.Status.BlockTime
+		tx.Confirmations = getConfirmationsFromHeight(tx.BlockHeight, tipHeight)
+	}
+	return tx, nil
+}
+
+// GetTxTimes returns the block time of each transaction, Esplora does not tell when
+// unconfirmed transactions were first seen so their time is 0
+func (b *esploraBackend) GetTxTimes(txIDs []string) (map[string]BTCTxTime, map[string]error) {
+	times := map[string]BTCTxTime{}
+	errs := map[string]error{}
+	var lock sync.Mutex
+	runBounded(len(txIDs), serviceCfg.MaxConcurrentRPC, func(i int) {
+		tx, err := b.getTxStatus(txIDs[i])
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			errs[txIDs[i]] = err
+			return
+		}
+		times[txIDs[i]] = BTCTxTime{Time: tx.Status.BlockTime, Confirmed: tx.Status.Confirmed}
+	})
+	return times, errs
+}
+
+func (b *esploraBackend) GetTipHeight() (int64, error) {
+	body, err := b.get("/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+func (b *esploraBackend) Broadcast(txHex string) (string, error) {
+	response, err := b.client.R().
+		SetHeader("Content-Type", "text/plain").
+		SetBody(txHex).
+		Post(b.url + "/tx")
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode() != 200 {
+		return "", fmt.Errorf("Response status code: %v - %v", response.StatusCode(), strings.TrimSpace(response.String()))
+	}
+	return strings.TrimSpace(response.String()), nil
+}
+
+// EstimateFee uses the estimate of the largest target Esplora has not above confTarget,
+// estimates are only given for some targets
+func (b *esploraBackend) EstimateFee(confTarget int) (float64, error) {
+	body, err := b.get("/fee-estimates")
+	if err != nil {
+		return 0, err
+	}
+	var estimates map[string]float64
+	err = json.Unmarshal(body, &estimates)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse response: %v", string(body))
+	}
+	targets := []int{}
+	for key := range estimates {
+		target, err := strconv.Atoi(key)
+		if err == nil && target <= confTarget {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("No fee estimate for target %v", confTarget)
+	}
+	sort.Ints(targets)
+	return estimates[strconv.Itoa(targets[len(targets)-1])], nil
+}
+
+func (b *esploraBackend) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	body, err := b.get(fmt.Sprintf("/block-height/%v", height))
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(strings.TrimSpace(string(body)))
+}
+
+func (b *esploraBackend) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	body, err := b.get(fmt.Sprintf("/block/%v/raw", blockHash))
+	if err != nil {
+		return nil, err
+	}
+	var block wire.MsgBlock
+	err = block.Deserialize(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newTestTxHex returns a transaction paying 5000 satoshi to pkScript and its serialization
+func newTestTxHex(t *testing.T, pkScript []byte) (*wire.MsgTx, string) {
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	msgTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	msgTx.AddTxOut(wire.NewTxOut(5000, pkScript))
+	var buf bytes.Buffer
+	err := msgTx.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgTx, hex.EncodeToString(buf.Bytes())
+}
+
+func newEsploraStub(routes map[string]string) *httptest.Server {
+	mux := http.NewServeMux()
+	for path, body := range routes {
+		body := body
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestEsploraListUTXOs(t *testing.T) {
+	serviceCfg.MaxConcurrentRPC = 2
+	server := newEsploraStub(map[string]string{
+		"/blocks/tip/height": "100",
+		"/address/addr1/utxo": `[
+			{"txid": "tip", "vout": 0, "value": 1000, "status": {"confirmed": true, "block_height": 100}},
+			{"txid": "deep", "vout": 1, "value": 2000, "status": {"confirmed": true, "block_height": 91}},
+			{"txid": "mempool", "vout": 0, "value": 3000, "status": {"confirmed": false}}
+		]`,
+		// indexed from a block the tip height has not caught up with yet
+		"/address/addr2/utxo": `[{"txid": "ahead", "vout": 0, "value": 4000, "status": {"confirmed": true, "block_height": 101}}]`,
+	})
+	defer server.Close()
+	backend := newEsploraBackend(server.URL + "/")
+
+	utxos, err := backend.ListUTXOs([]string{"addr1", "addr2"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"tip": 1, "deep": 10, "mempool": 0, "ahead": 0}
+	if len(utxos) != len(want) {
+		t.Fatalf("got %v utxos, want %v", len(utxos), len(want))
+	}
+	for _, u := range utxos {
+		if u.Confirmations != want[u.TxID] {
+			t.Errorf("utxo %v has %v confirmations, want %v", u.TxID, u.Confirmations, want[u.TxID])
+		}
+	}
+
+	utxos, err = backend.ListUTXOs([]string{"addr1", "addr2"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 || utxos[0].TxID != "tip" || utxos[1].TxID != "deep" || utxos[1].Address != "addr1" {
+		t.Errorf("got utxos %+v, want tip and deep of addr1", utxos)
+	}
+
+	_, err = backend.ListUTXOs([]string{"addr1", "unknown"}, 1)
+	if err == nil {
+		t.Errorf("listing utxos of an address the stub does not serve succeeded")
+	}
+}
+
+func TestEsploraGetTx(t *testing.T) {
+	msgTx, txHex := newTestTxHex(t, []byte{0x51})
+	txID := msgTx.TxHash().String()
+	blockHash := (&chainhash.Hash{2}).String()
+	server := newEsploraStub(map[string]string{
+		"/blocks/tip/height": "100",
+		"/tx/" + txID: fmt.Sprintf(`{"txid": "%v", "status": {"confirmed": true, "block_height": 95, "block_hash": "%v", "block_time": 1600000000}}`,
+			txID, blockHash),
+		"/tx/" + txID + "/hex": txHex + "\n",
+		"/tx/mempool":          `{"txid": "mempool", "status": {"confirmed": false}}`,
+		"/tx/mempool/hex":      txHex,
+	})
+	defer server.Close()
+	backend := newEsploraBackend(server.URL)
+
+	tx, err := backend.GetTx(txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.BlockHeight != 95 || tx.BlockHash != blockHash || tx.BlockTime != 1600000000 || tx.Confirmations != 6 {
+		t.Errorf("got block %v %v at %v with %v confirmations", tx.BlockHeight, tx.BlockHash, tx.BlockTime, tx.Confirmations)
+	}
+	if tx.MsgTx.TxHash().String() != txID || tx.MsgTx.TxOut[0].Value != 5000 {
+		t.Errorf("decoded transaction %v does not match", tx.MsgTx.TxHash())
+	}
+
+	tx, err = backend.GetTx("mempool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.BlockHeight != 0 || tx.BlockHash != "" || tx.Confirmations != 0 {
+		t.Errorf("unconfirmed transaction has block %v %v and %v confirmations", tx.BlockHeight, tx.BlockHash, tx.Confirmations)
+	}
+}
+
+func TestEsploraEstimateFee(t *testing.T) {
+	server := newEsploraStub(map[string]string{
+		"/fee-estimates": `{"2": 40.5, "3": 30, "6": 20, "144": 1.5}`,
+	})
+	defer server.Close()
+	backend := newEsploraBackend(server.URL)
+
+	for confTarget, want := range map[int]float64{2: 40.5, 5: 30, 6: 20, 100: 20, 1008: 1.5} {
+		feeRate, err := backend.EstimateFee(confTarget)
+		if err != nil {
+			t.Errorf("target %v: %v", confTarget, err)
+			continue
+		}
+		if feeRate != want {
+			t.Errorf("target %v uses %v, want %v", confTarget, feeRate, want)
+		}
+	}
+	_, err := backend.EstimateFee(1)
+	if err == nil {
+		t.Errorf("target 1 has no estimate at or below it but did not fail")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// feeRateCache holds the last successful fee rate estimates so fee lookups neither wait for
+// nor fail with the fee sources, each target keeps its last estimate when a refresh misses it
+type feeRateCache struct {
+	lock      sync.RWMutex
+	feeRates  map[string]float64
+	updatedAt map[string]time.Time
+	// coldLock lets a single request refresh the rates while nothing has been cached
+	coldLock sync.Mutex
+}
+
+var feeCache feeRateCache
+
+func startFeeRateRefresher() {
+	log.Println("starting fee rate refresher...")
+	for {
+		err := refreshFeeRates()
+		if err != nil {
+			log.Printf("Could not refresh fee rates - Error %v\n", err)
+		}
+		time.Sleep(FeeRefreshInterval)
+	}
+}
+
+func refreshFeeRates() error {
+	newFeeRates, err := estimateFeeRates()
+	if err != nil {
+		return err
+	}
+	feeCache.lock.Lock()
+	defer feeCache.lock.Unlock()
+	// readers keep the previous maps so they are copied rather than updated in place
+	feeRates := map[string]float64{}
+	updatedAt := map[string]time.Time{}
+	for target, feeRate := range feeCache.feeRates {
+		feeRates[target] = feeRate
+		updatedAt[target] = feeCache.updatedAt[target]
+	}
+	now := time.Now()
+	for target, feeRate := range newFeeRates {
+		feeRates[target] = feeRate
+		updatedAt[target] = now
+	}
+	feeCache.feeRates = feeRates
+	feeCache.updatedAt = updatedAt
+	return nil
+}
+
+// readFeeRates returns the cached fee rates with the time of the oldest target estimate
+func readFeeRates() (map[string]float64, time.Time) {
+	feeCache.lock.RLock()
+	defer feeCache.lock.RUnlock()
+	lastUpdated := time.Time{}
+	for _, t := range feeCache.updatedAt {
+		if lastUpdated.IsZero() || t.Before(lastUpdated) {
+			lastUpdated = t
+		}
+	}
+	return feeCache.feeRates, lastUpdated
+}
+
+// getCachedFeeRates returns the cached fee rates with the time of the oldest target estimate
+// and whether it is stale, it only waits for the fee sources if nothing has been cached yet
+func getCachedFeeRates() (map[string]float64, time.Time, bool, error) {
+	feeRates, lastUpdated := readFeeRates()
+	if feeRates == nil {
+		feeCache.coldLock.Lock()
+		// another request may have refreshed the rates while this one was waiting
+		feeRates, lastUpdated = readFeeRates()
+		if feeRates == nil {
+			err := refreshFeeRates()
+			if err != nil {
+				feeCache.coldLock.Unlock()
+				return nil, time.Time{}, false, fmt.Errorf("No fee rate has been cached - Error %v", err)
+			}
+			feeRates, lastUpdated = readFeeRates()
+		}
+		feeCache.coldLock.Unlock()
+	}
+	return feeRates, lastUpdated, time.Since(lastUpdated) > FeeStaleAfter, nil
+}
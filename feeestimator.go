@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// a P2WSH input without its witness: outpoint (36), empty script sig (1) and sequence (4)
+	vBytePerInputBase = 41.0
+	// a P2WSH output: value (8), script length (1) and script (34)
+	vBytePerOutput = 43.0
+	// version, locktime, input and output counts plus the segwit marker and flag
+	vByteOverhead = 10.75
+	// upper bound of a DER encoded signature with its sighash type
+	maxSignatureSize = 73
+	// fee multiplier to make sure unshielding transactions are mined in time
+	unshieldFeeOverpay = 1.15
+	// number of inputs assumed when no amount is given
+	defaultUnshieldInputs = 2
+)
+
+// getVBytePerInput returns the virtual size of a P2WSH m-of-n multisig input
+func getVBytePerInput(keySet *PortalKeySet) float64 {
+	numPubKeys := len(keySet.MasterPubKeys)
+	redeemScriptSize := 3 + numPubKeys*34
+	// item count, OP_CHECKMULTISIG dummy item, signatures and redeem script
+	witnessSize := 1 + 1 + keySet.NumSigsRequired*maxSignatureSize + 1 + redeemScriptSize
+	if redeemScriptSize >= 0xfd {
+		witnessSize += 2
+	}
+	return vBytePerInputBase + float64(witnessSize)/4.0
+}
+
+func estimateUnshieldVBytes(numInputs int, numOutputs int, keySet *PortalKeySet) float64 {
+	return float64(numInputs)*getVBytePerInput(keySet) + float64(numOutputs)*vBytePerOutput + vByteOverhead
+}
+
+// getPortalChangeAddresses returns the change address of each key set, where the portal
+// sends the change of unshielding transactions
+func getPortalChangeAddresses() ([]string, error) {
+	btcAddresses := []string{}
+	for _, keySet := range portalKeySets {
+		changeAddress, err := generateBTCAddress("", keySet)
+		if err != nil {
+			return nil, err
+		}
+		btcAddresses = append(btcAddresses, changeAddress)
+	}
+	return btcAddresses, nil
+}
+
+// selectPortalUTXOs picks the largest confirmed UTXOs of the portal until they cover
+// amount plus the fee of spending them, it returns the number of inputs needed
+func selectPortalUTXOs(amount btcutil.Amount, feePerVByte float64, numOutputs int, keySet *PortalKeySet) (int, error) {
+	utxos, err := getCachedPortalUTXOs()
+	if err != nil {
+		return 0, err
+	}
+
+	total := btcutil.Amount(0)
+	for i, u := range utxos {
+		total += btcutil.Amount(u.Amount)
+		fee := feePerVByte * estimateUnshieldVBytes(i+1, numOutputs, keySet) * unshieldFeeOverpay
+		if total >= amount+btcutil.Amount(fee) {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("Portal utxos (%v) are not enough to unshield %v", total, amount)
+}
+
+// estimateUnshieldingFee estimates the fee of paying amount (in satoshi) out of the portal
+// at the rate of target, a zero amount falls back to the default number of inputs
+func estimateUnshieldingFee(amount btcutil.Amount, target string) (*API_estimated_unshielding_fee_respond, error) {
+	feeRates, lastUpdated, isStale, err := getCachedFeeRates()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get bitcoin fee, error: %v", err)
+	}
+	feePerVByte, ok := feeRates[target]
+	if !ok {
+		return nil, fmt.Errorf("Could not get bitcoin fee of target %v", target)
+	}
+
+	keySet := getCurrentPortalKeySet()
+	// payment to the user and change back to the portal
+	numOutputs := 2
+	numInputs := defaultUnshieldInputs
+	if amount > 0 {
+		numInputs, err = selectPortalUTXOs(amount, feePerVByte, numOutputs, keySet)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vBytes := estimateUnshieldVBytes(numInputs, numOutputs, keySet)
+	feeSat := uint64(math.Ceil(feePerVByte * vBytes * unshieldFeeOverpay))
+	return &API_estimated_unshielding_fee_respond{
+		Inputs:   numInputs,
+		Outputs:  numOutputs,
+		VBytes:   vBytes,
+		TokenID:  BTCTokenID,
+		Target:   target,
+		FeeRate:  feePerVByte,
+		FeeRates: feeRates,
+		FeeSat:   feeSat,
+		FeePBTC:  convertSatAmtToPBTCAmt(int64(feeSat)),
+		// convert to msec
+		FeeUpdatedAt: lastUpdated.UnixNano() / int64(time.Millisecond),
+		IsStale:      isStale,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// FeeSource estimates the BTC fee rate in satoshi per vbyte to be mined within confTarget blocks
+type FeeSource interface {
+	Name() string
+	EstimateFeeRate(confTarget int) (float64, error)
+}
+
+type BlockchainFeeResponse struct {
+	Result float64
+	Error  error
+}
+
+// backendFeeSource asks the bitcoin backend for its fee estimate
+type backendFeeSource struct{}
+
+func (s *backendFeeSource) Name() string {
+	return btcBackend.Name()
+}
+
+func (s *backendFeeSource) EstimateFeeRate(confTarget int) (float64, error) {
+	return btcBackend.EstimateFee(confTarget)
+}
+
+// blockchainFeeHostSource is the external fee host, it returns the same rate for every target
+type blockchainFeeHostSource struct {
+	host   string
+	client *resty.Client
+}
+
+func (s *blockchainFeeHostSource) Name() string {
+	return "blockchainfee"
+}
+
+func (s *blockchainFeeHostSource) EstimateFeeRate(confTarget int) (float64, error) {
+	response, err := s.client.R().
+		Get(s.host)
+
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode() != 200 {
+		return 0, fmt.Errorf("Response status code: %v", response.StatusCode())
+	}
+	var responseBody BlockchainFeeResponse
+	err = json.Unmarshal(response.Body(), &responseBody)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse response: %v", response.Body())
+	}
+	return responseBody.Result, nil
+}
+
+// staticFeeSource returns the configured rates, it is only used when every other source fails
+type staticFeeSource struct {
+	feeRates map[string]float64
+}
+
+func (s *staticFeeSource) Name() string {
+	return "static"
+}
+
+func (s *staticFeeSource) EstimateFeeRate(confTarget int) (float64, error) {
+	for target, blocks := range FeeTargets {
+		if blocks == confTarget {
+			if feeRate, ok := s.feeRates[target]; ok {
+				return feeRate, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("No static fee rate for target %v", confTarget)
+}
+
+var feeSources []FeeSource
+var fallbackFeeSource FeeSource
+
+func initFeeSources() {
+	feeSources = []FeeSource{&backendFeeSource{}}
+	if serviceCfg.BlockchainFeeHost != "" {
+		feeSources = append(feeSources, &blockchainFeeHostSource{
+			host:   serviceCfg.BlockchainFeeHost,
+			client: resty.New().SetTimeout(FeeHostTimeout),
+		})
+	}
+	if len(serviceCfg.Fee.StaticFeeRates) > 0 {
+		fallbackFeeSource = &staticFeeSource{feeRates: serviceCfg.Fee.StaticFeeRates}
+	}
+}
+
+// estimateFeeRate aggregates the estimates of all sources for confTarget by median,
+// falls back to the static rates if none answers and clamps the result
+func estimateFeeRate(confTarget int) (float64, error) {
+	feeRates := []float64{}
+	for _, source := range feeSources {
+		feeRate, err := source.EstimateFeeRate(confTarget)
+		if err != nil {
+			log.Printf("Could not get fee rate from %v - Error %v\n", source.Name(), err)
+			continue
+		}
+		feeRates = append(feeRates, feeRate)
+	}
+	if len(feeRates) == 0 {
+		if fallbackFeeSource == nil {
+			return 0, fmt.Errorf("No fee source is available")
+		}
+		feeRate, err := fallbackFeeSource.EstimateFeeRate(confTarget)
+		if err != nil {
+			return 0, err
+		}
+		feeRates = append(feeRates, feeRate)
+	}
+
+	sort.Float64s(feeRates)
+	median := feeRates[len(feeRates)/2]
+	if len(feeRates)%2 == 0 {
+		median = (feeRates[len(feeRates)/2-1] + feeRates[len(feeRates)/2]) / 2
+	}
+	return clampFeeRate(median), nil
+}
+
+func clampFeeRate(feeRate float64) float64 {
+	if feeRate < serviceCfg.Fee.MinFeeRate {
+		return serviceCfg.Fee.MinFeeRate
+	}
+	if feeRate > serviceCfg.Fee.MaxFeeRate {
+		return serviceCfg.Fee.MaxFeeRate
+	}
+	return feeRate
+}
+
+// estimateFeeRates returns the fee rate of every target, targets without estimate are left out
+func estimateFeeRates() (map[string]float64, error) {
+	feeRates := map[string]float64{}
+	for target, blocks := range FeeTargets {
+		feeRate, err := estimateFeeRate(blocks)
+		if err != nil {
+			log.Printf("Could not estimate fee rate of target %v - Error %v\n", target, err)
+			continue
+		}
+		feeRates[target] = feeRate
+	}
+	if len(feeRates) == 0 {
+		return nil, fmt.Errorf("Could not estimate fee rate of any target")
+	}
+	return feeRates, nil
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcutil"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
 	"github.com/kamva/mgm/v3"
@@ -28,10 +29,17 @@ func startGinService() {
 	r.GET("/health", API_HealthCheck)
 	r.GET("/checkportalshieldingaddressexisted", API_CheckPortalShieldingAddressExisted)
 	r.POST("/addportalshieldingaddress", API_AddPortalShieldingAddress)
+	r.GET("/generateportalshieldingaddress", API_GeneratePortalShieldingAddress)
 	r.GET("/getlistportalshieldingaddress", API_GetListPortalShieldingAddress)
+	r.GET("/getportalshieldingaddressesbyincaddress", API_GetPortalShieldingAddressesByIncAddress)
+	r.GET("/getportalshieldingaddressimportstatus", API_GetPortalShieldingAddressImportStatus)
 	r.GET("/getestimatedunshieldingfee", API_GetEstimatedUnshieldingFee)
 	r.GET("/getshieldhistory", API_GetShieldHistory)
 	r.GET("/getshieldhistorybyexternaltxid", API_GetShieldHistoryByExternalTxID)
+	r.POST("/getshieldstatusbyexternaltxids", API_GetShieldStatusByExternalTxIDs)
+	r.POST("/addportalshieldrequest", API_AddPortalShieldRequest)
+	r.POST("/addportalunshieldrequest", API_AddPortalUnshieldRequest)
+	r.GET("/getunshieldhistory", API_GetUnshieldHistory)
 	err := r.Run("0.0.0.0:" + strconv.Itoa(serviceCfg.APIPort))
 	if err != nil {
 		panic(err)
@@ -63,14 +71,13 @@ func API_AddPortalShieldingAddress(c *gin.Context) {
 		return
 	}
 
-	err = isValidPortalAddressPair(req.IncAddress, req.BTCAddress)
+	keySetEpoch, err := isValidPortalAddressPair(req.IncAddress, req.BTCAddress)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
 		return
 	}
 
-	// check unique
-	isExisted, err := DBCheckPortalAddressExisted(req.IncAddress, req.BTCAddress)
+	isExisted, err := registerPortalAddress(req.IncAddress, req.BTCAddress, keySetEpoch)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
 		return
@@ -84,21 +91,72 @@ func API_AddPortalShieldingAddress(c *gin.Context) {
 		return
 	}
 
-	err = importBTCAddressToFullNode(req.BTCAddress)
+	c.JSON(http.StatusOK, API_respond{
+		Result: true,
+		Error:  nil,
+	})
+}
+
+func API_GeneratePortalShieldingAddress(c *gin.Context) {
+	incAddress := c.Query("incaddress")
+	register, err := strconv.ParseBool(c.DefaultQuery("register", "false"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
 		return
 	}
 
-	item := NewPortalAddressData(req.IncAddress, req.BTCAddress)
-	err = DBSavePortalAddress(*item)
+	err = isValidIncAddress(incAddress)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+
+	keySet := getCurrentPortalKeySet()
+	if c.Query("epoch") != "" {
+		epoch, err := strconv.Atoi(c.Query("epoch"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
+			return
+		}
+		keySet, err = getPortalKeySetByEpoch(epoch)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+			return
+		}
+		if !isPortalKeySetActive(keySet) {
+			c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Portal key set epoch %v is not active yet", epoch)))
+			return
+		}
+	}
+
+	redeemScript, childPubKeys, btcAddress, err := generateBTCAddressWithScript(incAddress, keySet)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
 		return
 	}
 
+	result := API_generate_portal_shielding_address_respond{
+		IncAddress:   incAddress,
+		BTCAddress:   btcAddress,
+		RedeemScript: hex.EncodeToString(redeemScript),
+		ChildPubKeys: []string{},
+		KeySetEpoch:  keySet.Epoch,
+	}
+	for _, pubKey := range childPubKeys {
+		result.ChildPubKeys = append(result.ChildPubKeys, hex.EncodeToString(pubKey))
+	}
+
+	if register {
+		_, err = registerPortalAddress(incAddress, btcAddress, keySet.Epoch)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+			return
+		}
+		result.Registered = true
+	}
+
 	c.JSON(http.StatusOK, API_respond{
-		Result: true,
+		Result: result,
 		Error:  nil,
 	})
 }
@@ -123,18 +181,82 @@ func API_GetListPortalShieldingAddress(c *gin.Context) {
 	})
 }
 
+func API_GetPortalShieldingAddressesByIncAddress(c *gin.Context) {
+	incAddresses := parseIncAddressesQuery(c)
+	if len(incAddresses) == 0 || len(incAddresses) > MaxIncAddressesPerRequest {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
+		return
+	}
+
+	list, err := DBGetPortalAddressesByIncAddresses(incAddresses)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
+	}
+
+	result := map[string][]PortalAddressData{}
+	for _, incAddress := range incAddresses {
+		result[incAddress] = []PortalAddressData{}
+	}
+	for _, a := range list {
+		result[a.IncAddress] = append(result[a.IncAddress], a)
+	}
+
+	c.JSON(http.StatusOK, API_respond{
+		Result: result,
+		Error:  nil,
+	})
+}
+
+func API_GetPortalShieldingAddressImportStatus(c *gin.Context) {
+	btcAddress := c.Query("btcaddress")
+	if btcAddress == "" {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
+		return
+	}
+
+	list, err := DBGetPortalAddressesByBTCAddresses([]string{btcAddress})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
+	}
+	if len(list) == 0 {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("BTC address %v is not registered", btcAddress)))
+		return
+	}
+
+	c.JSON(http.StatusOK, API_respond{
+		Result: getPortalAddressImportStatus(&list[0]),
+		Error:  nil,
+	})
+}
+
 func API_GetEstimatedUnshieldingFee(c *gin.Context) {
-	vBytePerInput := 192.25
-	vBytePerOutput := 43.0
-	vByteOverhead := 10.75
+	tokenID := c.Query("tokenid")
+	if tokenID != BTCTokenID {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"TokenID is not a portal token %v", tokenID)))
+		return
+	}
 
-	feePerVByte, err := getBitcoinFee()
+	// amount is in pBTC base units, 0 when unset
+	amount, err := strconv.ParseUint(c.DefaultQuery("amount", "0"), 10, 64)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(fmt.Errorf("Could not get bitcoin fee, error: %v", err)))
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
+		return
+	}
+
+	target := c.DefaultQuery("target", FeeTargetFast)
+	if _, ok := FeeTargets[target]; !ok {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid fee target %v", target)))
+		return
+	}
+
+	estimatedFee, err := estimateUnshieldingFee(convertPBTCAmtToSatAmt(amount), target)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
 		return
 	}
-	estimatedFee := feePerVByte * (2.0*vBytePerInput + 2.0*vBytePerOutput + vByteOverhead)
-	estimatedFee *= 1.15 // overpay
 
 	c.JSON(http.StatusOK, API_respond{
 		Result: estimatedFee,
@@ -143,7 +265,7 @@ func API_GetEstimatedUnshieldingFee(c *gin.Context) {
 }
 
 func API_GetShieldHistory(c *gin.Context) {
-	incAddress := c.Query("incaddress")
+	incAddresses := parseIncAddressesQuery(c)
 	tokenID := c.Query("tokenid")
 	if tokenID != BTCTokenID {
 		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
@@ -151,44 +273,41 @@ func API_GetShieldHistory(c *gin.Context) {
 		return
 	}
 
-	btcAddressStr, err := DBGetBTCAddressByIncAddress(incAddress)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(fmt.Errorf(
-			"Could not get btc address by inc address %v from DB", incAddress)))
+	if len(incAddresses) == 0 || len(incAddresses) > MaxIncAddressesPerRequest {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
 		return
 	}
 
-	btcAddress, err := btcutil.DecodeAddress(btcAddressStr, BTCChainCfg)
+	filter, limit, err := parseShieldHistoryQuery(c)
 	if err != nil {
-		log.Printf(fmt.Sprintf("Could not decode address %v - with err: %v", btcAddressStr, err))
-		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(
-			fmt.Errorf("Could not decode address %v - with err: %v", btcAddressStr, err)))
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
 		return
 	}
 
-	// time1 := time.Now()
-	utxos, err := btcClient.ListUnspentMinMaxAddresses(BTCMinConf, BTCMaxConf, []btcutil.Address{btcAddress})
+	histories, err := getPortalShieldHistories(incAddresses)
 	if err != nil {
-		log.Printf(fmt.Sprintf("Could not get utxos of address %v - with err: %v", btcAddressStr, err))
+		log.Printf(fmt.Sprintf("Could not get histories of inc addresses %v - with err: %v", incAddresses, err))
 		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(
-			fmt.Errorf("Could not get utxos of address %v - with err: %v", btcAddressStr, err)))
+			fmt.Errorf("Could not get histories of inc addresses %v - with err: %v", incAddresses, err)))
 		return
 	}
-	// log.Printf("Time call api btc fullnode: %v\n", time.Since(time1))
 
-	// time2 := time.Now()
-	histories, err := ParseUTXOsToPortalShieldHistory(utxos, incAddress)
+	page, total, nextCursor, err := paginateShieldHistories(histories, filter, c.Query("cursor"), limit)
 	if err != nil {
-		log.Printf(fmt.Sprintf("Could not get histories from utxos of address %v - with err: %v", btcAddressStr, err))
-		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(
-			fmt.Errorf("Could not get histories from utxos of address  %v - with err: %v", btcAddressStr, err)))
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
 		return
 	}
-	// log.Printf("Time parsing: %v\n", time.Since(time2))
 
+	failedTxIDs := getFailedTxIDs(histories)
 	c.JSON(http.StatusOK, API_respond{
-		Result: histories,
-		Error:  nil,
+		Result: API_shield_history_respond{
+			Histories:   page,
+			Total:       total,
+			NextCursor:  nextCursor,
+			Partial:     len(failedTxIDs) > 0,
+			FailedTxIDs: failedTxIDs,
+		},
+		Error: nil,
 	})
 }
 
@@ -201,31 +320,210 @@ func API_GetShieldHistoryByExternalTxID(c *gin.Context) {
 		return
 	}
 
-	txIDHash, err := chainhash.NewHashFromStr(externalTxID)
+	_, err := chainhash.NewHashFromStr(externalTxID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, buildGinErrorRespond(
 			fmt.Errorf("Invalid external txID %v - with err: %v", externalTxID, err)))
 		return
 	}
 
-	res, err := btcClient.GetTransaction(txIDHash)
+	shieldStatus, err := getPortalShieldStatus(externalTxID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(
-			fmt.Errorf("Could not get external txID %v - with err: %v", externalTxID, err)))
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
+	}
+	c.JSON(http.StatusOK, API_respond{
+		Result: shieldStatus,
+		Error:  nil,
+	})
+}
+
+func API_GetShieldStatusByExternalTxIDs(c *gin.Context) {
+	var req API_get_shield_status_by_external_txids_request
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+	if req.TokenID != BTCTokenID {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"TokenID is not a portal token %v", req.TokenID)))
+		return
+	}
+	if len(req.ExternalTxIDs) == 0 || len(req.ExternalTxIDs) > MaxExternalTxIDsPerRequest {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf("Invalid parameters")))
+		return
+	}
+
+	c.JSON(http.StatusOK, API_respond{
+		Result: getPortalShieldStatuses(req.ExternalTxIDs),
+		Error:  nil,
+	})
+}
+
+// API_AddPortalShieldRequest registers the Incognito shielding request submitted for a deposit so
+// its status can be looked up on the chain
+func API_AddPortalShieldRequest(c *gin.Context) {
+	var req API_add_portal_shield_request
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+	if incRPCServer == nil {
+		c.JSON(http.StatusServiceUnavailable, buildGinErrorRespond(fmt.Errorf(
+			"Incognito fullnode is not configured, shield requests cannot be tracked")))
+		return
+	}
+	if req.TokenID != BTCTokenID {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"TokenID is not a portal token %v", req.TokenID)))
 		return
 	}
+	err = isValidIncAddress(req.IncAddress)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+	for _, txID := range []string{req.ExternalTxID, req.ReqTxID} {
+		_, err = chainhash.NewHashFromStr(txID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, buildGinErrorRespond(
+				fmt.Errorf("Invalid tx ID %v - with err: %v", txID, err)))
+			return
+		}
+	}
 
-	status := getStatusFromConfirmation(int(res.Confirmations))
-	history := PortalShieldHistory{
-		ExternalTxID:  externalTxID,
-		Status:        status,
-		Confirmations: res.Confirmations,
+	isExisted, err := DBCheckPortalShieldRequestExisted(req.ReqTxID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
 	}
+	if isExisted {
+		msg := "Record has already been inserted"
+		c.JSON(http.StatusOK, API_respond{
+			Result: nil,
+			Error:  &msg,
+		})
+		return
+	}
+	// requests not processed by the chain yet are checked when their status is looked up
+	reqStatus, err := getPortalShieldingRequestStatus(req.ReqTxID)
+	if err == nil && reqStatus != nil &&
+		(reqStatus.IncAddressStr != req.IncAddress || reqStatus.ExternalTxID != req.ExternalTxID) {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"Shield request %v does not shield external tx id %v to inc address %v", req.ReqTxID, req.ExternalTxID, req.IncAddress)))
+		return
+	}
+
+	item := NewPortalShieldRequestData(req.IncAddress, req.ExternalTxID, req.ReqTxID, req.TokenID)
+	err = DBSavePortalShieldRequest(*item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
+	}
+
 	c.JSON(http.StatusOK, API_respond{
-		Result: history,
+		Result: true,
 		Error:  nil,
 	})
+}
+
+func API_AddPortalUnshieldRequest(c *gin.Context) {
+	var req API_add_portal_unshield_request
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+	if incRPCServer == nil {
+		c.JSON(http.StatusServiceUnavailable, buildGinErrorRespond(fmt.Errorf(
+			"Incognito fullnode is not configured, unshield requests cannot be tracked")))
+		return
+	}
+	if req.TokenID != BTCTokenID {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"TokenID is not a portal token %v", req.TokenID)))
+		return
+	}
+	err = isValidIncAddress(req.IncAddress)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+	_, err = chainhash.NewHashFromStr(req.UnshieldID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(
+			fmt.Errorf("Invalid unshield ID %v - with err: %v", req.UnshieldID, err)))
+		return
+	}
 
+	isExisted, err := DBCheckPortalUnshieldExisted(req.UnshieldID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
+	}
+	if isExisted {
+		msg := "Record has already been inserted"
+		c.JSON(http.StatusOK, API_respond{
+			Result: nil,
+			Error:  &msg,
+		})
+		return
+	}
+
+	// requests not found on the Incognito chain yet are checked by the unshield tracker
+	reqStatus, err := getPortalUnshieldRequestStatus(req.UnshieldID)
+	if err == nil && !isUnshieldRequestOwnedBy(reqStatus, req.IncAddress, req.TokenID) {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"Unshield %v does not belong to inc address %v", req.UnshieldID, req.IncAddress)))
+		return
+	}
+
+	item := NewPortalUnshieldData(req.IncAddress, req.UnshieldID, req.TokenID)
+	err = DBSavePortalUnshield(*item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, API_respond{
+		Result: true,
+		Error:  nil,
+	})
+}
+
+func API_GetUnshieldHistory(c *gin.Context) {
+	incAddress := c.Query("incaddress")
+	tokenID := c.Query("tokenid")
+	if tokenID != BTCTokenID {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(fmt.Errorf(
+			"TokenID is not a portal token %v", tokenID)))
+		return
+	}
+	err := isValidIncAddress(incAddress)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildGinErrorRespond(err))
+		return
+	}
+
+	unshields, err := DBGetPortalUnshieldsByIncAddress(incAddress, tokenID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(fmt.Errorf(
+			"Could not get unshields of inc address %v from DB", incAddress)))
+		return
+	}
+	tipHeight, err := btcBackend.GetTipHeight()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildGinErrorRespond(fmt.Errorf(
+			"Could not get tip height - with err: %v", err)))
+		return
+	}
+
+	c.JSON(http.StatusOK, API_respond{
+		Result: ParseUnshieldsToPortalUnshieldHistory(unshields, tipHeight),
+		Error:  nil,
+	})
 }
 
 func API_HealthCheck(c *gin.Context) {
@@ -239,16 +537,68 @@ func API_HealthCheck(c *gin.Context) {
 		status = "unhealthy"
 		mongoStatus = "disconnected"
 	}
-	err = btcClient.Ping()
+	_, err = btcBackend.GetTipHeight()
 	if err != nil {
 		status = "unhealthy"
 		btcNodeStatus = "disconnected"
 	}
-	c.JSON(http.StatusOK, gin.H{
+	result := gin.H{
 		"status":      status,
 		"mongo":       mongoStatus,
 		"btcfullnode": btcNodeStatus,
-	})
+		"btcbackend":  btcBackend.Name(),
+	}
+	if backend, ok := btcBackend.(*bitcoindBackend); ok {
+		result["btcnodes"] = backend.NodeStatuses()
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// parseIncAddressesQuery reads incaddress and the comma separated incaddresses of batch requests
+func parseIncAddressesQuery(c *gin.Context) []string {
+	incAddresses := []string{}
+	seen := map[string]bool{}
+	for _, incAddress := range append([]string{c.Query("incaddress")}, strings.Split(c.Query("incaddresses"), ",")...) {
+		incAddress = strings.TrimSpace(incAddress)
+		if incAddress == "" || seen[incAddress] {
+			continue
+		}
+		seen[incAddress] = true
+		incAddresses = append(incAddresses, incAddress)
+	}
+	return incAddresses
+}
+
+// parseShieldHistoryQuery reads the filter and page size of history requests,
+// times are in msec and amounts in pBTC base units like the histories
+func parseShieldHistoryQuery(c *gin.Context) (ShieldHistoryFilter, int, error) {
+	filter := ShieldHistoryFilter{}
+	invalidErr := fmt.Errorf("Invalid parameters")
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultHistoryPageSize)))
+	if err != nil || limit <= 0 || limit > MaxHistoryPageSize {
+		return filter, 0, invalidErr
+	}
+	if c.Query("status") != "" {
+		status, err := strconv.Atoi(c.Query("status"))
+		if err != nil {
+			return filter, 0, invalidErr
+		}
+		filter.Status = &status
+	}
+	filter.FromTime, err = strconv.ParseInt(c.DefaultQuery("from", "0"), 10, 64)
+	if err != nil {
+		return filter, 0, invalidErr
+	}
+	filter.ToTime, err = strconv.ParseInt(c.DefaultQuery("to", "0"), 10, 64)
+	if err != nil {
+		return filter, 0, invalidErr
+	}
+	filter.MinAmount, err = strconv.ParseUint(c.DefaultQuery("minamount", "0"), 10, 64)
+	if err != nil {
+		return filter, 0, invalidErr
+	}
+	return filter, limit, nil
 }
 
 func buildGinErrorRespond(err error) *API_respond {
@@ -1,4 +1,4 @@
-module main
+module portal-backend
 
 go 1.13
 
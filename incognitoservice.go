@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/incognitochain/go-incognito-sdk-v2/rpchandler"
+)
+
+var incRPCServer *rpchandler.RPCServer
+
+// shieldStatusCache keeps the shield status of deposits the Incognito chain has accepted or rejected,
+// which no longer changes
+var shieldStatusCache *txLRU
+
+// incBeaconHeight is the latest known Incognito beacon height, 0 until it has been fetched
+var incBeaconHeight uint64
+
+type IncBeaconBestState struct {
+	BeaconHeight uint64
+}
+
+// IncPortalShieldingRequestStatus is the shielding request status returned by the Incognito chain
+// RPC getportalshieldingrequeststatus
+type IncPortalShieldingRequestStatus struct {
+	Status        byte
+	Error         string
+	TokenID       string
+	IncAddressStr string
+	ExternalTxID  string
+	MintingAmount uint64
+	TxReqID       string
+}
+
+// IncPortalUnshieldRequestStatus is the unshielding request status stored by the Incognito chain
+type IncPortalUnshieldRequestStatus struct {
+	IncAddressStr  string
+	RemoteAddress  string
+	TokenID        string
+	UnshieldAmount uint64
+	UnshieldID     string
+	ExternalTxID   string
+	ExternalFee    uint64
+	Status         int
+}
+
+func initIncognitoService() {
+	if serviceCfg.IncognitoFullnode == "" {
+		log.Println("incognito fullnode is not configured, shield statuses are only based on BTC confirmations")
+		return
+	}
+	incRPCServer = rpchandler.NewRPCServer(serviceCfg.IncognitoFullnode)
+	err := refreshBeaconHeight()
+	if err != nil {
+		log.Printf("Could not get beacon height - Error %v\n", err)
+	}
+}
+
+// startBeaconHeightTracker keeps incBeaconHeight up to date for key set activations
+func startBeaconHeightTracker() {
+	if incRPCServer == nil {
+		return
+	}
+	for {
+		time.Sleep(BeaconHeightInterval)
+		err := refreshBeaconHeight()
+		if err != nil {
+			log.Printf("Could not get beacon height - Error %v\n", err)
+		}
+	}
+}
+
+func refreshBeaconHeight() error {
+	responseInBytes, err := incRPCServer.SendQuery(IncRPCGetBeaconBestState, []interface{}{})
+	if err != nil {
+		return err
+	}
+	var bestState *IncBeaconBestState
+	err = rpchandler.ParseResponse(responseInBytes, &bestState)
+	if err != nil {
+		return err
+	}
+	if bestState == nil {
+		return fmt.Errorf("Beacon best state not found")
+	}
+	atomic.StoreUint64(&incBeaconHeight, bestState.BeaconHeight)
+	return nil
+}
+
+// getPortalShieldingRequestStatus returns the status of the shielding request submitted in
+// reqTxID, nil if the chain has not processed it yet
+func getPortalShieldingRequestStatus(reqTxID string) (*IncPortalShieldingRequestStatus, error) {
+	params := []interface{}{
+		map[string]interface{}{
+			"ReqTxID": reqTxID,
+		},
+	}
+	responseInBytes, err := incRPCServer.SendQuery(IncRPCGetShieldingStatus, params)
+	if err != nil {
+		return nil, err
+	}
+	var status *IncPortalShieldingRequestStatus
+	err = rpchandler.ParseResponse(responseInBytes, &status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func getPortalUnshieldRequestStatus(unshieldID string) (*IncPortalUnshieldRequestStatus, error) {
+	params := []interface{}{
+		map[string]interface{}{
+			"UnshieldID": unshieldID,
+		},
+	}
+	responseInBytes, err := incRPCServer.SendQuery(IncRPCGetUnshieldingStatus, params)
+	if err != nil {
+		return nil, err
+	}
+	var status *IncPortalUnshieldRequestStatus
+	err = rpchandler.ParseResponse(responseInBytes, &status)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, fmt.Errorf("Unshielding request %v not found", unshieldID)
+	}
+	return status, nil
+}
+
+// getShieldStatus returns the status of a deposit, confirmed deposits are checked against the
+// shielding requests registered for them to know whether the shield has been minted or rejected.
+// A deposit is shielded once any of its requests is accepted and failed once all are rejected
+func getShieldStatus(externalTxID string, confirmationBlks int) int {
+	status := getStatusFromConfirmation(confirmationBlks)
+	if incRPCServer == nil || status == ShieldStatusPending {
+		return status
+	}
+	if cached, ok := shieldStatusCache.get(externalTxID); ok {
+		return int(cached)
+	}
+
+	requests, err := DBGetPortalShieldRequestsByExternalTxID(externalTxID)
+	if err != nil {
+		log.Printf("Could not get shielding requests of external tx id %v - Error %v\n", externalTxID, err)
+		return status
+	}
+	rejected := 0
+	for _, request := range requests {
+		shieldStatus, err := getPortalShieldingRequestStatus(request.ReqTxID)
+		if err != nil {
+			log.Printf("Could not get shielding request status of request %v - Error %v\n", request.ReqTxID, err)
+			return status
+		}
+		if shieldStatus == nil || shieldStatus.ExternalTxID != externalTxID {
+			// not processed yet, or registered for another deposit before it was processed
+			continue
+		}
+		switch shieldStatus.Status {
+		case IncPortalRequestAcceptedStatus:
+			shieldStatusCache.add(externalTxID, int64(ShieldStatusSuccess))
+			return ShieldStatusSuccess
+		case IncPortalRequestRejectedStatus:
+			rejected++
+		}
+	}
+	if len(requests) > 0 && rejected == len(requests) {
+		// not cached as the deposit can still be shielded by a new request
+		return ShieldStatusFailed
+	}
+	return status
+}
@@ -16,6 +16,16 @@ func main() {
 		panic(err)
 	}
 	initPortalService()
+	initIncognitoService()
+	go startBeaconHeightTracker()
+	initFeeSources()
+	go startBTCNodeHealthChecker()
+	go startAddressImporter()
+	go startFeeRateRefresher()
+	go startPortalUTXORefresher()
+	go startBlockScanner()
+	go startDepositWatcher()
+	go startUnshieldTracker()
 	go startGinService()
 	if ENABLE_PROFILER {
 		http.ListenAndServe("localhost:8091", nil)
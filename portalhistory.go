@@ -1,28 +1,56 @@
 package main
 
 import (
-	"github.com/btcsuite/btcd/btcjson"
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"encoding/base64"
+	"fmt"
 	"log"
-	"sync"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil"
 )
 
 type PortalShieldHistory struct {
-	Amount           uint64 `json:"amount,omitempty"`
-	ExternalTxID     string `json:"externalTxID"`
-	IncognitoAddress string `json:"incognitoAddress,omitempty"`
-	Status           int    `json:"status"`
-	Time             int64  `json:"time,omitempty"`
-	Confirmations    int64  `json:"confirmations"`
+	Amount                uint64 `json:"amount,omitempty"`
+	ExternalTxID          string `json:"externalTxID"`
+	IncognitoAddress      string `json:"incognitoAddress,omitempty"`
+	Status                int    `json:"status"`
+	Time                  int64  `json:"time,omitempty"`
+	Confirmations         int64  `json:"confirmations"`
+	Reason                string `json:"reason,omitempty"`
+	RequiredConfirmations int64  `json:"requiredConfirmations"`
+	// Degraded is set when some fields could not be loaded, Error tells why
+	Degraded bool   `json:"degraded,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	vout uint32
+}
+
+// ShieldHistoryFilter drops histories not matching, zero values disable a criterion
+type ShieldHistoryFilter struct {
+	Status    *int
+	FromTime  int64 // in msec
+	ToTime    int64 // in msec
+	MinAmount uint64
 }
 
 const ShieldStatusFailed = 0
 const ShieldStatusSuccess = 1
 const ShieldStatusPending = 2
 const ShieldStatusProcessing = 3
+const ShieldStatusOrphaned = 4
+const ShieldStatusBelowMinimum = 5
+const ShieldStatusReadyToShield = 6
+const ShieldStatusNotPortalDeposit = 7
 
-func convertBTCAmtToPBTCAmt(btcAmt float64) uint64 {
-	return uint64(btcAmt*1e8+0.5) * 10
+func convertSatAmtToPBTCAmt(satAmt int64) uint64 {
+	return uint64(satAmt) * 10
+}
+
+func convertPBTCAmtToSatAmt(pBTCAmt uint64) btcutil.Amount {
+	return btcutil.Amount(pBTCAmt / 10)
 }
 
 func getStatusFromConfirmation(confirmationBlks int) (status int) {
@@ -30,48 +58,259 @@ func getStatusFromConfirmation(confirmationBlks int) (status int) {
 	if confirmationBlks > 0 {
 		status = ShieldStatusProcessing
 	}
+	if confirmationBlks >= requiredConfirmations {
+		status = ShieldStatusReadyToShield
+	}
 	return
 }
 
+// getDustAmount returns the amount (in pBTC base units) under which a deposit costs more
+// to spend at the dust relay fee rate than it is worth
+func getDustAmount() uint64 {
+	vBytes := getVBytePerInput(getCurrentPortalKeySet()) + vBytePerOutput
+	return convertSatAmtToPBTCAmt(int64(math.Ceil(vBytes * DustRelayFeeRate)))
+}
+
+// applyShieldAmountCheck flags deposits the portal will not accept, shields already
+// resolved by the Incognito chain keep their status
+func applyShieldAmountCheck(status int, amount uint64) (int, string) {
+	if status == ShieldStatusSuccess || status == ShieldStatusFailed {
+		return status, ""
+	}
+	if amount < getDustAmount() {
+		return ShieldStatusBelowMinimum, fmt.Sprintf("Deposit is dust, it must be at least %v", getDustAmount())
+	}
+	if amount < minShieldAmount {
+		return ShieldStatusBelowMinimum, fmt.Sprintf("Deposit is below the minimum shielding amount %v", minShieldAmount)
+	}
+	return status, ""
+}
+
+// ParseUTXOsToPortalShieldHistory maps each UTXO to the Incognito address owning its BTC address,
+// entries whose transaction could not be loaded are kept as degraded and an error is only
+// returned when none of them could be loaded
 func ParseUTXOsToPortalShieldHistory(
-	utxos []btcjson.ListUnspentResult, incAddress string,
+	utxos []BTCUTXO, incAddresses map[string]string,
 ) ([]PortalShieldHistory, error) {
-	histories := []PortalShieldHistory{}
-
-	var wg sync.WaitGroup
-	result := make(chan PortalShieldHistory, len(utxos))
+	txIDs := []string{}
 	for _, u := range utxos {
-		u := u
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			status := getStatusFromConfirmation(int(u.Confirmations))
-			txIDHash, err := chainhash.NewHashFromStr(u.TxID)
-			if err != nil {
-				log.Printf("Could not new hash from external tx id %v - Error %v\n", u.TxID, err)
-				return
-			}
-			tx, err := btcClient.GetTransaction(txIDHash)
-			if err != nil {
-				log.Printf("Could not get external tx id %v - Error %v\n", u.TxID, err)
-				return
-			}
-			result <- PortalShieldHistory{
-				Amount:           convertBTCAmtToPBTCAmt(u.Amount),
-				ExternalTxID:     u.TxID,
-				IncognitoAddress: incAddress,
-				Status:           status,
-				Time:             tx.Time * 1000, // convert to msec
-				Confirmations:    u.Confirmations,
-			}
-		}()
-	}
-	wg.Wait()
-	close(result)
-
-	for h := range result {
-		histories = append(histories, h)
+		txIDs = append(txIDs, u.TxID)
 	}
+	txTimes, txErrs := getTxTimes(txIDs)
+
+	histories := make([]PortalShieldHistory, len(utxos))
+	runBounded(len(utxos), serviceCfg.MaxConcurrentRPC, func(i int) {
+		u := utxos[i]
+		status := getShieldStatus(u.TxID, int(u.Confirmations))
+		amount := convertSatAmtToPBTCAmt(u.Amount)
+		status, reason := applyShieldAmountCheck(status, amount)
+		histories[i] = PortalShieldHistory{
+			Amount:                amount,
+			ExternalTxID:          u.TxID,
+			IncognitoAddress:      incAddresses[u.Address],
+			Status:                status,
+			Time:                  txTimes[u.TxID] * 1000, // convert to msec
+			Confirmations:         u.Confirmations,
+			Reason:                reason,
+			RequiredConfirmations: int64(requiredConfirmations),
+			vout:                  u.Vout,
+		}
+		if err, ok := txErrs[u.TxID]; ok {
+			log.Printf("Could not get external tx id %v - Error %v\n", u.TxID, err)
+			histories[i].Degraded = true
+			histories[i].Error = fmt.Sprintf("Could not get external tx id %v - Error %v", u.TxID, err)
+		}
+	})
 
+	if len(utxos) > 0 && len(txTimes) == 0 {
+		return histories, fmt.Errorf("Could not get any of %v external txs", len(txErrs))
+	}
 	return histories, nil
 }
+
+// getFailedTxIDs returns the external tx ids of degraded histories
+func getFailedTxIDs(histories []PortalShieldHistory) []string {
+	failedTxIDs := []string{}
+	seen := map[string]bool{}
+	for _, h := range histories {
+		if h.Degraded && !seen[h.ExternalTxID] {
+			seen[h.ExternalTxID] = true
+			failedTxIDs = append(failedTxIDs, h.ExternalTxID)
+		}
+	}
+	return failedTxIDs
+}
+
+// ParseDepositsToPortalShieldHistory looks the shield status of each deposit up concurrently,
+// keeping the order of deposits
+func ParseDepositsToPortalShieldHistory(deposits []PortalDepositData, tipHeight int64) []PortalShieldHistory {
+	histories := make([]PortalShieldHistory, len(deposits))
+	runBounded(len(deposits), serviceCfg.MaxConcurrentRPC, func(i int) {
+		d := deposits[i]
+		history := PortalShieldHistory{
+			Amount:                convertSatAmtToPBTCAmt(d.Amount),
+			ExternalTxID:          d.ExternalTxID,
+			IncognitoAddress:      d.IncAddress,
+			Time:                  d.BlockTime * 1000, // convert to msec
+			RequiredConfirmations: int64(requiredConfirmations),
+			vout:                  d.Vout,
+		}
+		if d.Orphaned {
+			// the block was reorged out, the deposit has no confirmation until it is mined again
+			history.Status = ShieldStatusOrphaned
+		} else {
+			history.Confirmations = getConfirmationsFromHeight(d.BlockHeight, tipHeight)
+			status := getShieldStatus(d.ExternalTxID, int(history.Confirmations))
+			history.Status, history.Reason = applyShieldAmountCheck(status, history.Amount)
+		}
+		histories[i] = history
+	})
+	return histories
+}
+
+// getPortalShieldHistories merges the deposit ledger with the current UTXOs of every BTC address
+// of incAddresses, the ledger keeps deposits that have been spent while UTXOs cover those not indexed yet
+func getPortalShieldHistories(incAddresses []string) ([]PortalShieldHistory, error) {
+	addresses, err := DBGetPortalAddressesByIncAddresses(incAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get btc addresses by inc addresses %v from DB - with err: %v", incAddresses, err)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("No btc address is registered for inc addresses %v", incAddresses)
+	}
+	incAddressByBTCAddress := map[string]string{}
+	btcAddresses := []string{}
+	for _, a := range addresses {
+		incAddressByBTCAddress[a.BTCAddress] = a.IncAddress
+		btcAddresses = append(btcAddresses, a.BTCAddress)
+	}
+
+	tipHeight, err := btcBackend.GetTipHeight()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get tip height - with err: %v", err)
+	}
+	deposits, err := DBGetPortalDepositsByIncAddresses(incAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get deposits of inc addresses %v from DB - with err: %v", incAddresses, err)
+	}
+	utxos, err := btcBackend.ListUTXOs(btcAddresses, BTCMinConf)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get utxos of addresses %v - with err: %v", btcAddresses, err)
+	}
+
+	unspent := map[string]bool{}
+	for _, u := range utxos {
+		unspent[fmt.Sprintf("%v:%v", u.TxID, u.Vout)] = true
+	}
+	recorded := map[string]bool{}
+	validDeposits := []PortalDepositData{}
+	for _, d := range deposits {
+		key := fmt.Sprintf("%v:%v", d.ExternalTxID, d.Vout)
+		if d.Orphaned && unspent[key] {
+			// an orphaned deposit back in the mempool or re-mined is pending again
+			continue
+		}
+		recorded[key] = true
+		validDeposits = append(validDeposits, d)
+	}
+	notRecordedUTXOs := []BTCUTXO{}
+	for _, u := range utxos {
+		if !recorded[fmt.Sprintf("%v:%v", u.TxID, u.Vout)] {
+			notRecordedUTXOs = append(notRecordedUTXOs, u)
+		}
+	}
+
+	histories := ParseDepositsToPortalShieldHistory(validDeposits, tipHeight)
+	utxoHistories, err := ParseUTXOsToPortalShieldHistory(notRecordedUTXOs, incAddressByBTCAddress)
+	if err != nil {
+		if len(histories) == 0 {
+			return nil, err
+		}
+		// the ledger still has histories to return along with the degraded ones
+		log.Printf("Could not get histories from utxos of inc addresses %v - Error %v\n", incAddresses, err)
+	}
+	return append(histories, utxoHistories...), nil
+}
+
+func (f *ShieldHistoryFilter) match(h PortalShieldHistory) bool {
+	if f.Status != nil && h.Status != *f.Status {
+		return false
+	}
+	if f.FromTime > 0 && h.Time < f.FromTime {
+		return false
+	}
+	if f.ToTime > 0 && h.Time >= f.ToTime {
+		return false
+	}
+	return h.Amount >= f.MinAmount
+}
+
+// isShieldHistoryBefore orders histories by time descending, ties broken by external tx id and vout
+func isShieldHistoryBefore(a, b PortalShieldHistory) bool {
+	if a.Time != b.Time {
+		return a.Time > b.Time
+	}
+	if a.ExternalTxID != b.ExternalTxID {
+		return a.ExternalTxID > b.ExternalTxID
+	}
+	return a.vout > b.vout
+}
+
+func encodeShieldHistoryCursor(h PortalShieldHistory) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v_%v_%v", h.Time, h.ExternalTxID, h.vout)))
+}
+
+func decodeShieldHistoryCursor(cursor string) (*PortalShieldHistory, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor %v", cursor)
+	}
+	parts := strings.Split(string(data), "_")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid cursor %v", cursor)
+	}
+	t, err1 := strconv.ParseInt(parts[0], 10, 64)
+	vout, err2 := strconv.ParseUint(parts[2], 10, 32)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("Invalid cursor %v", cursor)
+	}
+	return &PortalShieldHistory{Time: t, ExternalTxID: parts[1], vout: uint32(vout)}, nil
+}
+
+// paginateShieldHistories sorts the histories matching filter by time descending and returns
+// up to limit of them after cursor, along with the number of matches and the cursor of the next page
+func paginateShieldHistories(
+	histories []PortalShieldHistory, filter ShieldHistoryFilter, cursor string, limit int,
+) ([]PortalShieldHistory, int, string, error) {
+	matched := []PortalShieldHistory{}
+	for _, h := range histories {
+		if filter.match(h) {
+			matched = append(matched, h)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return isShieldHistoryBefore(matched[i], matched[j])
+	})
+
+	start := 0
+	if cursor != "" {
+		last, err := decodeShieldHistoryCursor(cursor)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		start = sort.Search(len(matched), func(i int) bool {
+			return isShieldHistoryBefore(*last, matched[i])
+		})
+	}
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := matched[start:end]
+	nextCursor := ""
+	if end < len(matched) {
+		nextCursor = encodeShieldHistoryCursor(page[len(page)-1])
+	}
+	return page, len(matched), nextCursor, nil
+}
@@ -3,25 +3,19 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/hdkeychain"
-	resty "github.com/go-resty/resty/v2"
 	"github.com/incognitochain/go-incognito-sdk-v2/wallet"
 )
 
-var btcClient *rpcclient.Client
-
-type BlockchainFeeResponse struct {
-	Result float64
-	Error  error
-}
-
-var masterPubKeys = [][]byte{
+// mainnetMasterPubKeys are the master public keys of the mainnet portal beacon committee
+var mainnetMasterPubKeys = [][]byte{
 	[]byte{0x2, 0x39, 0x42, 0x3d, 0xad, 0x93, 0x8f, 0xcb, 0xe5, 0xb5, 0xef, 0x7b, 0x7b, 0x9a, 0xf, 0x28,
 		0x4, 0x19, 0x53, 0x66, 0x7f, 0xee, 0x72, 0xe4, 0x81, 0xf9, 0xe6, 0xb, 0x81, 0x41, 0xd7, 0x3a, 0x36},
 	[]byte{0x2, 0x8d, 0xc, 0xd7, 0x83, 0x9d, 0x5e, 0xc5, 0x7b, 0x77, 0x1a, 0xf1, 0x2, 0xb8, 0x72, 0xd0,
@@ -37,37 +31,111 @@ var masterPubKeys = [][]byte{
 	[]byte{0x2, 0x65, 0x96, 0x49, 0xab, 0xd4, 0xe5, 0x97, 0x7d, 0x5b, 0x67, 0x4c, 0x6d, 0xa1, 0xf, 0x9,
 		0x28, 0xa0, 0x8c, 0x67, 0x8d, 0x7f, 0x50, 0xcc, 0x10, 0xf0, 0xfe, 0xe5, 0x68, 0xa8, 0x57, 0x63, 0xd8},
 }
-var numSigsRequired = 5
-var chainCfg = &chaincfg.MainNetParams
+var mainnetNumSigsRequired = 5
+
+// testnetMasterPubKeys are the keys testnet addresses have always been derived from, with the
+// testnet HD params, so addresses registered before key sets were configurable stay valid
+var testnetMasterPubKeys = mainnetMasterPubKeys
+var testnetNumSigsRequired = 5
+
+// PortalKeySet is one epoch of the portal beacon committee keys, a new epoch is added on every key rotation
+type PortalKeySet struct {
+	Epoch            int
+	ActivationHeight uint64
+	ActivationTime   int64
+	MasterPubKeys    [][]byte
+	NumSigsRequired  int
+}
+
+// portalKeySets are the key set epochs of the configured network ordered by epoch, set in readConfigAndArg
+var portalKeySets []*PortalKeySet
+
+// isPortalKeySetActive tells whether keySet has been activated, by the Incognito beacon height
+// if it has an activation height or by time otherwise. The first epoch is always active
+func isPortalKeySetActive(keySet *PortalKeySet) bool {
+	if keySet == portalKeySets[0] {
+		return true
+	}
+	if keySet.ActivationHeight > 0 {
+		beaconHeight := atomic.LoadUint64(&incBeaconHeight)
+		return beaconHeight > 0 && beaconHeight >= keySet.ActivationHeight
+	}
+	return keySet.ActivationTime <= time.Now().Unix()
+}
+
+// getCurrentPortalKeySet returns the latest key set epoch that has been activated
+func getCurrentPortalKeySet() *PortalKeySet {
+	current := portalKeySets[0]
+	for _, keySet := range portalKeySets {
+		if isPortalKeySetActive(keySet) {
+			current = keySet
+		}
+	}
+	return current
+}
+
+func getPortalKeySetByEpoch(epoch int) (*PortalKeySet, error) {
+	for _, keySet := range portalKeySets {
+		if keySet.Epoch == epoch {
+			return keySet, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown portal key set epoch %v", epoch)
+}
 
 func initPortalService() {
 	err := DBCreatePortalAddressIndex()
 	if err != nil {
 		panic(err)
 	}
-
-	connCfg := &rpcclient.ConnConfig{
-		Host:         serviceCfg.BTCFullnode.Address,
-		User:         serviceCfg.BTCFullnode.User,
-		Pass:         serviceCfg.BTCFullnode.Password,
-		HTTPPostMode: true,                          // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   !serviceCfg.BTCFullnode.Https, // Bitcoin core does not provide TLS by default
+	err = DBCreatePortalDepositIndex()
+	if err != nil {
+		panic(err)
+	}
+	err = DBCreateScannedBlockIndex()
+	if err != nil {
+		panic(err)
+	}
+	err = DBCreatePortalUnshieldIndex()
+	if err != nil {
+		panic(err)
+	}
+	err = DBCreatePortalShieldRequestIndex()
+	if err != nil {
+		panic(err)
 	}
-	btcClient, err = rpcclient.New(connCfg, nil)
+
+	btcBackend, err = newBitcoinBackend()
 	if err != nil {
 		panic(err)
 	}
+	txTimeCache = newTxLRU(serviceCfg.TxTimeCacheSize)
+	shieldStatusCache = newTxLRU(serviceCfg.TxTimeCacheSize)
 
 }
 
-func importBTCAddressToFullNode(btcAddress string) error {
-	err := btcClient.ImportAddressRescan(btcAddress, "", false)
-	return err
+// registerPortalAddress saves the pair with a pending import picked up by the address importer,
+// it returns true without doing anything if the pair has already been registered
+func registerPortalAddress(incAddress, btcAddress string, keySetEpoch int) (bool, error) {
+	isExisted, err := DBCheckPortalAddressExisted(incAddress, btcAddress)
+	if err != nil {
+		return false, err
+	}
+	if isExisted {
+		return true, nil
+	}
+
+	item := NewPortalAddressData(incAddress, btcAddress, keySetEpoch)
+	err = DBSavePortalAddress(*item)
+	if err != nil {
+		return false, err
+	}
+	return false, nil
 }
 
-func generateOTMultisigAddress(masterPubKeys [][]byte, numSigsRequired int, chainCodeSeed string, chainParam *chaincfg.Params) ([]byte, string, error) {
+func generateOTMultisigAddress(masterPubKeys [][]byte, numSigsRequired int, chainCodeSeed string, chainParam *chaincfg.Params) ([]byte, [][]byte, string, error) {
 	if len(masterPubKeys) < numSigsRequired || numSigsRequired < 0 {
-		return []byte{}, "", fmt.Errorf("Invalid signature requirement")
+		return []byte{}, nil, "", fmt.Errorf("Invalid signature requirement")
 	}
 
 	pubKeys := [][]byte{}
@@ -82,7 +150,7 @@ func generateOTMultisigAddress(masterPubKeys [][]byte, numSigsRequired int, chai
 			extendedBTCChildPubKey, _ := extendedBTCPublicKey.Child(0)
 			childPubKey, err := extendedBTCChildPubKey.ECPubKey()
 			if err != nil {
-				return []byte{}, "", fmt.Errorf("Master BTC Public Key (#%v) %v is invalid - Error %v", idx, masterPubKey, err)
+				return []byte{}, nil, "", fmt.Errorf("Master BTC Public Key (#%v) %v is invalid - Error %v", idx, masterPubKey, err)
 			}
 			pubKeys = append(pubKeys, childPubKey.SerializeCompressed())
 		}
@@ -103,61 +171,60 @@ func generateOTMultisigAddress(masterPubKeys [][]byte, numSigsRequired int, chai
 
 	redeemScript, err := builder.Script()
 	if err != nil {
-		return []byte{}, "", fmt.Errorf("Could not build script - Error %v", err)
+		return []byte{}, nil, "", fmt.Errorf("Could not build script - Error %v", err)
 	}
 
 	// generate P2WSH address
 	scriptHash := sha256.Sum256(redeemScript)
 	addr, err := btcutil.NewAddressWitnessScriptHash(scriptHash[:], chainParam)
 	if err != nil {
-		return []byte{}, "", fmt.Errorf("Could not generate address from script - Error %v", err)
+		return []byte{}, nil, "", fmt.Errorf("Could not generate address from script - Error %v", err)
 	}
 	addrStr := addr.EncodeAddress()
 
-	return redeemScript, addrStr, nil
+	return redeemScript, pubKeys, addrStr, nil
 }
 
-func generateBTCAddress(incAddress string) (string, error) {
-	_, address, err := generateOTMultisigAddress(masterPubKeys, numSigsRequired, incAddress, chainCfg)
+func generateBTCAddress(incAddress string, keySet *PortalKeySet) (string, error) {
+	_, _, address, err := generateOTMultisigAddress(keySet.MasterPubKeys, keySet.NumSigsRequired, incAddress, BTCChainCfg)
 	if err != nil {
 		return "", err
 	}
 	return address, nil
 }
 
-func isValidPortalAddressPair(incAddress string, btcAddress string) error {
-	_, err := wallet.Base58CheckDeserialize(incAddress)
-	if err != nil {
-		return err
-	}
-
-	generatedBTCAddress, err := generateBTCAddress(incAddress)
-	if err != nil {
-		return err
-	}
-	if generatedBTCAddress != btcAddress {
-		return fmt.Errorf("Invalid BTC address")
-	}
-
-	return nil
+// generateBTCAddressWithScript returns the P2WSH address of incAddress under keySet along with
+// the redeem script and the child public keys it commits to
+func generateBTCAddressWithScript(incAddress string, keySet *PortalKeySet) ([]byte, [][]byte, string, error) {
+	return generateOTMultisigAddress(keySet.MasterPubKeys, keySet.NumSigsRequired, incAddress, BTCChainCfg)
 }
 
-func getBitcoinFee() (float64, error) {
-	client := resty.New()
-
-	response, err := client.R().
-		Get(serviceCfg.BlockchainFeeHost)
+func isValidIncAddress(incAddress string) error {
+	_, err := wallet.Base58CheckDeserialize(incAddress)
+	return err
+}
 
+// isValidPortalAddressPair checks btcAddress against every key set epoch, newest first,
+// and returns the epoch it was generated from
+func isValidPortalAddressPair(incAddress string, btcAddress string) (int, error) {
+	err := isValidIncAddress(incAddress)
 	if err != nil {
 		return 0, err
 	}
-	if response.StatusCode() != 200 {
-		return 0, fmt.Errorf("Response status code: %v", response.StatusCode())
-	}
-	var responseBody BlockchainFeeResponse
-	err = json.Unmarshal(response.Body(), &responseBody)
-	if err != nil {
-		return 0, fmt.Errorf("Could not parse response: %v", response.Body())
+
+	for i := len(portalKeySets) - 1; i >= 0; i-- {
+		if !isPortalKeySetActive(portalKeySets[i]) {
+			// addresses of future epochs must not receive deposits yet
+			continue
+		}
+		generatedBTCAddress, err := generateBTCAddress(incAddress, portalKeySets[i])
+		if err != nil {
+			return 0, err
+		}
+		if generatedBTCAddress == btcAddress {
+			return portalKeySets[i].Epoch, nil
+		}
 	}
-	return responseBody.Result, nil
+
+	return 0, fmt.Errorf("Invalid BTC address")
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+type PortalShieldOutput struct {
+	Vout             uint32 `json:"vout"`
+	BTCAddress       string `json:"btcAddress,omitempty"`
+	IncognitoAddress string `json:"incognitoAddress,omitempty"`
+	Amount           uint64 `json:"amount"`
+}
+
+// PortalShieldStatus is the status of one external transaction, Amount sums the outputs paying
+// registered portal addresses and BTCAddress and IncognitoAddress are only set when they all pay
+// the same address, Outputs tells what each address is paid.
+// Error is set instead of the other fields when the transaction could not be looked up
+type PortalShieldStatus struct {
+	ExternalTxID          string               `json:"externalTxID"`
+	Status                int                  `json:"status"`
+	Confirmations         int64                `json:"confirmations"`
+	RequiredConfirmations int64                `json:"requiredConfirmations"`
+	Amount                uint64               `json:"amount,omitempty"`
+	BTCAddress            string               `json:"btcAddress,omitempty"`
+	IncognitoAddress      string               `json:"incognitoAddress,omitempty"`
+	PaysPortalAddress     bool                 `json:"paysPortalAddress"`
+	Reason                string               `json:"reason,omitempty"`
+	Outputs               []PortalShieldOutput `json:"outputs,omitempty"`
+	Error                 string               `json:"error,omitempty"`
+}
+
+// getPortalShieldStatus looks the transaction up in the bitcoin backend so it does not need
+// to pay an imported address, amounts are in pBTC base units
+func getPortalShieldStatus(externalTxID string) (*PortalShieldStatus, error) {
+	txIDHash, err := chainhash.NewHashFromStr(externalTxID)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid external txID %v - with err: %v", externalTxID, err)
+	}
+	tx, err := btcBackend.GetTx(txIDHash.String())
+	if err != nil {
+		return nil, fmt.Errorf("Could not get external txID %v - with err: %v", externalTxID, err)
+	}
+
+	shieldStatus := &PortalShieldStatus{
+		ExternalTxID:          externalTxID,
+		Confirmations:         tx.Confirmations,
+		Outputs:               []PortalShieldOutput{},
+		RequiredConfirmations: int64(requiredConfirmations),
+	}
+	for vout, out := range tx.MsgTx.TxOut {
+		output := PortalShieldOutput{Vout: uint32(vout), Amount: convertSatAmtToPBTCAmt(out.Value)}
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, BTCChainCfg)
+		if err == nil && len(addresses) == 1 {
+			output.BTCAddress = addresses[0].EncodeAddress()
+		}
+		shieldStatus.Outputs = append(shieldStatus.Outputs, output)
+	}
+
+	err = matchPortalShieldOutputs(shieldStatus)
+	if err != nil {
+		return nil, fmt.Errorf("Could not match outputs of external txID %v - with err: %v", externalTxID, err)
+	}
+	if !shieldStatus.PaysPortalAddress {
+		shieldStatus.Status = ShieldStatusNotPortalDeposit
+		shieldStatus.Reason = "Transaction does not pay any registered portal address"
+		return shieldStatus, nil
+	}
+	shieldStatus.Status = getShieldStatus(externalTxID, int(tx.Confirmations))
+	shieldStatus.Status, shieldStatus.Reason = applyShieldAmountCheck(shieldStatus.Status, shieldStatus.Amount)
+	return shieldStatus, nil
+}
+
+// matchPortalShieldOutputs maps the outputs paying registered portal addresses back to
+// their Incognito address and sums what they pay
+func matchPortalShieldOutputs(shieldStatus *PortalShieldStatus) error {
+	btcAddresses := []string{}
+	for _, output := range shieldStatus.Outputs {
+		if output.BTCAddress != "" {
+			btcAddresses = append(btcAddresses, output.BTCAddress)
+		}
+	}
+	if len(btcAddresses) == 0 {
+		return nil
+	}
+	addresses, err := DBGetPortalAddressesByBTCAddresses(btcAddresses)
+	if err != nil {
+		return err
+	}
+	incAddressByBTCAddress := map[string]string{}
+	for _, a := range addresses {
+		incAddressByBTCAddress[a.BTCAddress] = a.IncAddress
+	}
+
+	paidAddresses := map[string]bool{}
+	for i := range shieldStatus.Outputs {
+		output := &shieldStatus.Outputs[i]
+		incAddress, ok := incAddressByBTCAddress[output.BTCAddress]
+		if !ok {
+			continue
+		}
+		output.IncognitoAddress = incAddress
+		shieldStatus.PaysPortalAddress = true
+		shieldStatus.Amount += output.Amount
+		paidAddresses[output.BTCAddress] = true
+	}
+	if len(paidAddresses) == 1 {
+		for btcAddress := range paidAddresses {
+			shieldStatus.BTCAddress = btcAddress
+			shieldStatus.IncognitoAddress = incAddressByBTCAddress[btcAddress]
+		}
+	}
+	return nil
+}
+
+// getPortalShieldStatuses looks the transactions up concurrently, keeping their order
+func getPortalShieldStatuses(externalTxIDs []string) []PortalShieldStatus {
+	statuses := make([]PortalShieldStatus, len(externalTxIDs))
+	runBounded(len(externalTxIDs), serviceCfg.MaxConcurrentRPC, func(i int) {
+		shieldStatus, err := getPortalShieldStatus(externalTxIDs[i])
+		if err != nil {
+			statuses[i] = PortalShieldStatus{ExternalTxID: externalTxIDs[i], Error: err.Error()}
+			return
+		}
+		statuses[i] = *shieldStatus
+	})
+	return statuses
+}
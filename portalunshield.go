@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type PortalUnshieldHistory struct {
+	UnshieldID       string `json:"unshieldID"`
+	IncognitoAddress string `json:"incognitoAddress"`
+	RemoteAddress    string `json:"remoteAddress,omitempty"`
+	Amount           uint64 `json:"amount,omitempty"`
+	ExternalTxID     string `json:"externalTxID,omitempty"`
+	ExternalFee      uint64 `json:"externalFee,omitempty"`
+	Status           int    `json:"status"`
+	Time             int64  `json:"time"`
+	Confirmations    int64  `json:"confirmations"`
+}
+
+const UnshieldStatusFailed = 0
+const UnshieldStatusSuccess = 1
+const UnshieldStatusPending = 2
+const UnshieldStatusProcessing = 3
+
+func startUnshieldTracker() {
+	if incRPCServer == nil {
+		log.Println("incognito fullnode is not configured, unshield requests will not be tracked")
+		return
+	}
+	log.Println("starting unshield tracker...")
+	for {
+		err := trackUnshields()
+		if err != nil {
+			log.Printf("Could not track unshields - Error %v\n", err)
+		}
+		time.Sleep(UnshieldTrackerInterval)
+	}
+}
+
+// trackUnshields updates unfinished unshields with their status on the Incognito chain
+// and the confirmations of the BTC transaction paying them out
+func trackUnshields() error {
+	unshields, err := DBGetUnfinishedPortalUnshields()
+	if err != nil {
+		return err
+	}
+	for i := range unshields {
+		u := &unshields[i]
+		reqStatus, err := getPortalUnshieldRequestStatus(u.UnshieldID)
+		if err != nil {
+			log.Printf("Could not get status of unshield %v - Error %v\n", u.UnshieldID, err)
+			continue
+		}
+		if !isUnshieldRequestOwnedBy(reqStatus, u.IncAddress, u.TokenID) {
+			log.Printf("Unshield %v was filed under %v but belongs to %v, deleting it\n", u.UnshieldID, u.IncAddress, reqStatus.IncAddressStr)
+			err = DBDeletePortalUnshield(u)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		u.RemoteAddress = reqStatus.RemoteAddress
+		u.Amount = reqStatus.UnshieldAmount
+		u.ExternalTxID = reqStatus.ExternalTxID
+		u.ExternalFee = reqStatus.ExternalFee
+		switch reqStatus.Status {
+		case IncPortalUnshieldWaitingStatus:
+			u.Status = UnshieldStatusPending
+		case IncPortalUnshieldProcessedStatus, IncPortalUnshieldCompletedStatus:
+			u.Status = UnshieldStatusProcessing
+			u.ExternalBlockHeight = getExternalTxBlockHeight(u.ExternalTxID)
+			if u.ExternalBlockHeight > 0 {
+				u.Status = UnshieldStatusSuccess
+			}
+		case IncPortalUnshieldRefundedStatus:
+			u.Status = UnshieldStatusFailed
+		}
+
+		err = DBUpdatePortalUnshield(u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnshieldRequestOwnedBy checks an unshield is filed under the address and token it was requested from
+func isUnshieldRequestOwnedBy(reqStatus *IncPortalUnshieldRequestStatus, incAddress string, tokenID string) bool {
+	return reqStatus.IncAddressStr == incAddress && reqStatus.TokenID == tokenID
+}
+
+// getExternalTxBlockHeight returns 0 if the transaction is unknown or not mined yet
+func getExternalTxBlockHeight(externalTxID string) int64 {
+	if externalTxID == "" {
+		return 0
+	}
+	tx, err := btcBackend.GetTx(externalTxID)
+	if err != nil {
+		return 0
+	}
+	return tx.BlockHeight
+}
+
+// ParseUnshieldsToPortalUnshieldHistory computes confirmations from the block heights recorded by
+// the unshield tracker so histories do not look transactions up
+func ParseUnshieldsToPortalUnshieldHistory(unshields []PortalUnshieldData, tipHeight int64) []PortalUnshieldHistory {
+	histories := []PortalUnshieldHistory{}
+	for _, u := range unshields {
+		histories = append(histories, PortalUnshieldHistory{
+			UnshieldID:       u.UnshieldID,
+			IncognitoAddress: u.IncAddress,
+			RemoteAddress:    u.RemoteAddress,
+			Amount:           u.Amount,
+			ExternalTxID:     u.ExternalTxID,
+			ExternalFee:      u.ExternalFee,
+			Status:           u.Status,
+			Time:             u.TimeStamp * 1000, // convert to msec
+			Confirmations:    getConfirmationsFromHeight(u.ExternalBlockHeight, tipHeight),
+		})
+	}
+	return histories
+}
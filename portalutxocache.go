@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// portalUTXOCache holds the confirmed UTXOs the portal can spend, largest first, so fee
+// estimates do not list UTXOs on each request
+type portalUTXOCache struct {
+	lock        sync.RWMutex
+	utxos       []BTCUTXO
+	lastUpdated time.Time
+}
+
+var utxoCache portalUTXOCache
+
+func startPortalUTXORefresher() {
+	log.Println("starting portal utxo refresher...")
+	interval := PortalUTXORefreshInterval
+	if btcBackend.Name() != BTCBackendBitcoind {
+		// public indexers rate limit clients, each address costs one request
+		interval = PortalUTXORefreshIntervalIndexer
+	}
+	for {
+		err := refreshPortalUTXOs()
+		if err != nil {
+			log.Printf("Could not refresh portal utxos - Error %v\n", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// refreshPortalUTXOs caches the UTXOs the portal can spend, those of the key set change addresses
+// and the deposits the Incognito chain has shielded. Without an Incognito fullnode deposits with
+// the required confirmations are assumed shielded
+func refreshPortalUTXOs() error {
+	changeAddresses, err := getPortalChangeAddresses()
+	if err != nil {
+		return fmt.Errorf("Could not get portal change addresses - Error %v", err)
+	}
+	deposits, err := DBGetUnorphanedPortalDeposits()
+	if err != nil {
+		return fmt.Errorf("Could not get portal deposits - Error %v", err)
+	}
+	tipHeight, err := btcBackend.GetTipHeight()
+	if err != nil {
+		return fmt.Errorf("Could not get tip height - Error %v", err)
+	}
+
+	isShielded := make([]bool, len(deposits))
+	runBounded(len(deposits), serviceCfg.MaxConcurrentRPC, func(i int) {
+		confirmations := getConfirmationsFromHeight(deposits[i].BlockHeight, tipHeight)
+		status := getShieldStatus(deposits[i].ExternalTxID, int(confirmations))
+		isShielded[i] = status == ShieldStatusSuccess || (incRPCServer == nil && status == ShieldStatusReadyToShield)
+	})
+	spendable := map[string]bool{}
+	btcAddresses := changeAddresses
+	listed := map[string]bool{}
+	for _, a := range changeAddresses {
+		listed[a] = true
+	}
+	for i, d := range deposits {
+		if !isShielded[i] {
+			continue
+		}
+		spendable[fmt.Sprintf("%v:%v", d.ExternalTxID, d.Vout)] = true
+		if !listed[d.BTCAddress] {
+			listed[d.BTCAddress] = true
+			btcAddresses = append(btcAddresses, d.BTCAddress)
+		}
+	}
+
+	utxos, err := btcBackend.ListUTXOs(btcAddresses, 1)
+	if err != nil {
+		return fmt.Errorf("Could not get portal utxos - Error %v", err)
+	}
+	isChange := map[string]bool{}
+	for _, a := range changeAddresses {
+		isChange[a] = true
+	}
+	portalUTXOs := []BTCUTXO{}
+	for _, u := range utxos {
+		if isChange[u.Address] || spendable[fmt.Sprintf("%v:%v", u.TxID, u.Vout)] {
+			portalUTXOs = append(portalUTXOs, u)
+		}
+	}
+	sort.Slice(portalUTXOs, func(i, j int) bool {
+		return portalUTXOs[i].Amount > portalUTXOs[j].Amount
+	})
+
+	utxoCache.lock.Lock()
+	defer utxoCache.lock.Unlock()
+	utxoCache.utxos = portalUTXOs
+	utxoCache.lastUpdated = time.Now()
+	return nil
+}
+
+// getCachedPortalUTXOs returns the cached portal UTXOs sorted by amount, largest first,
+// the returned slice is shared and must not be modified
+func getCachedPortalUTXOs() ([]BTCUTXO, error) {
+	utxoCache.lock.RLock()
+	defer utxoCache.lock.RUnlock()
+	if utxoCache.utxos == nil {
+		return nil, fmt.Errorf("No portal utxo has been cached yet")
+	}
+	return utxoCache.utxos, nil
+}